@@ -1,8 +1,15 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"errors"
+	"io"
+	"math"
+	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,6 +22,9 @@ const (
 	ebmlTagEBML            = 0x1A45DFA3
 	ebmlTagSegment         = 0x18538067
 	ebmlTagSeekHead        = 0x114D9B74
+	ebmlTagSeek            = 0x4DBB
+	ebmlTagSeekID          = 0x53AB
+	ebmlTagSeekPosition    = 0x53AC
 	ebmlTagInfo            = 0x1549A966
 	ebmlTagTimecodeScale   = 0x2AD7B1
 	ebmlTagDuration        = 0x4489
@@ -32,6 +42,8 @@ const (
 	ebmlTagFlagLacing      = 0x9C
 	ebmlTagDefaultDuration = 0x23E383
 	ebmlTagName            = 0x536E
+	ebmlTagLanguage        = 0x22B59C
+	ebmlTagLanguageIETF    = 0x22B59D
 	ebmlTagCodecID         = 0x86
 	ebmlTagCodecName       = 0x228688
 	ebmlTagVideo           = 0xE0
@@ -48,6 +60,11 @@ const (
 	ebmlTagReferenceBlock  = 0xFB
 	ebmlTagDiscardPadding  = 0x75A2
 	ebmlTagCues            = 0x1C53BB6B
+	ebmlTagCuePoint        = 0xBB
+	ebmlTagCueTime         = 0xB3
+	ebmlTagCueTrackPos     = 0xB7 // CueTrackPositions
+	ebmlTagCueTrack        = 0xF7
+	ebmlTagCueClusterPos   = 0xF1 // CueClusterPosition
 	ebmlTagChapters        = 0x1043A770
 	ebmlTagTags            = 0x1254C367
 	ebmlTagTag             = 0x7373
@@ -82,6 +99,27 @@ func fixedUint(data []byte) uint64 {
 	return x
 }
 
+// Same as `fixedUint`, but two's complement, e.g. for `ReferenceBlock`.
+func fixedInt(data []byte) int64 {
+	x := fixedUint(data)
+	if n := uint(len(data)) * 8; n != 0 && n < 64 && x>>(n-1) != 0 {
+		x -= 1 << n
+	}
+	return int64(x)
+}
+
+// Write a signed number into a fixed-width field (at most 8 bytes), clamping it
+// to the range of that width.
+func putFixedInt(data []byte, x int64) {
+	n := uint(len(data)) * 8
+	if n < 64 && x >= 1<<(n-1) {
+		x = 1<<(n-1) - 1
+	} else if n < 64 && x < -1<<(n-1) {
+		x = -1 << (n - 1)
+	}
+	putFixedUint(data, uint64(x)&(^uint64(0)>>(64-n)))
+}
+
 func ebmlTagID(data []byte) (uint64, int) {
 	if len(data) != 0 && data[0] != 0 {
 		// 1xxxxxxx
@@ -124,24 +162,186 @@ func ebmlParseTagIncomplete(data []byte) ebmlTag {
 	return ebmlTag{0, 0, 0}
 }
 
+// Same as `ebmlParseTagIncomplete`, but the tag must also fit into `data` entirely.
 func ebmlParseTag(data []byte) ebmlTag {
-	if tag := ebmlParseTagIncomplete(data); tag.Length+uint64(tag.Consumed) <= uint64(len(data)) {
+	// (Written so that it cannot overflow whatever the length is. `Consumed` is never
+	// more than `len(data)`, and is 0 when the tag is invalid, in which case so is `ID`.)
+	if tag := ebmlParseTagIncomplete(data); tag.Length <= uint64(len(data)-tag.Consumed) {
 		return tag
 	}
 	return ebmlTag{0, 0, 0}
 }
 
+// Whether the tag, as parsed from the start of `data`, fits into it.
+func (t ebmlTag) fits(data []byte) bool {
+	return t.Consumed <= len(data) && t.Length <= uint64(len(data)-t.Consumed)
+}
+
+// The contents of a tag that starts at the beginning of `data`, or nil if it's
+// truncated (which can only happen if it was not parsed with `ebmlParseTag`.)
 func (t ebmlTag) Contents(data []byte) []byte {
+	if !t.fits(data) {
+		return nil
+	}
 	return data[t.Consumed : uint64(t.Consumed)+t.Length]
 }
 
+// The rest of `data` after this tag. A truncated tag takes up everything.
 func (t ebmlTag) Skip(data []byte) []byte {
+	if !t.fits(data) {
+		return nil
+	}
 	return data[uint64(t.Consumed)+t.Length:]
 }
 
+// Collect string-valued `SimpleTag`s from the contents of a `Tag` (or another `SimpleTag`,
+// in which case names are prefixed with that of the parent, e.g. "ARTIST.URL".)
+// `Targets` are ignored, since we don't care which track or chapter a tag refers to.
+func ebmlParseSimpleTags(data []byte, prefix string, depth int, into map[string]string) error {
+	for len(data) != 0 {
+		tag := ebmlParseTag(data)
+
+		switch tag.ID {
+		case 0:
+			return errors.New("malformed EBML")
+
+		case ebmlTagSimpleTag:
+			name, value, isString := "", "", false
+			contents := tag.Contents(data)
+			for buf := contents; len(buf) != 0; {
+				tag2 := ebmlParseTag(buf)
+
+				switch tag2.ID {
+				case 0:
+					return errors.New("malformed EBML")
+
+				case ebmlTagTagName:
+					name = string(tag2.Contents(buf))
+
+				case ebmlTagTagString:
+					value, isString = string(tag2.Contents(buf)), true
+				}
+
+				buf = tag2.Skip(buf)
+			}
+
+			if name != "" {
+				if isString {
+					into[prefix+name] = value
+				}
+				if depth < 8 {
+					if err := ebmlParseSimpleTags(contents, prefix+name+".", depth+1, into); err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		data = tag.Skip(data)
+	}
+	return nil
+}
+
+// Split the contents of a Block (after the flags) into frames. Lacing modes are
+// 0 = none, 1 = Xiph, 2 = fixed-size, 3 = EBML; they are stored in bits 1-2 of the flags.
+func ebmlSplitLaces(lacing byte, data []byte) ([][]byte, error) {
+	if lacing == 0 {
+		return [][]byte{data}, nil
+	}
+	if len(data) == 0 {
+		return nil, errors.New("malformed lacing")
+	}
+	n := int(data[0]) + 1
+	data = data[1:]
+	// The last frame takes up whatever remains.
+	sizes := make([]uint64, n-1)
+
+	switch lacing {
+	case 1:
+		// Each size is a sum of bytes, all of which but the last are 255.
+		for i := range sizes {
+			for {
+				if len(data) == 0 {
+					return nil, errors.New("malformed lacing")
+				}
+				b := data[0]
+				data = data[1:]
+				sizes[i] += uint64(b)
+				if b != 255 {
+					break
+				}
+			}
+		}
+
+	case 2:
+		if len(data)%n != 0 {
+			return nil, errors.New("malformed lacing")
+		}
+		for i := range sizes {
+			sizes[i] = uint64(len(data) / n)
+		}
+
+	case 3:
+		// The first size is an EBML uint, the rest are signed differences from the previous
+		// one, stored as EBML uints with a bias of (2^(7 * length - 1) - 1).
+		for i := range sizes {
+			size, consumed := ebmlUint(data)
+			if consumed == 0 || size == ebmlIndeterminate {
+				return nil, errors.New("malformed lacing")
+			}
+			if i != 0 {
+				// Negative sizes wrap around and fail the bounds check below.
+				size = sizes[i-1] + size - (1<<uint(7*consumed-1) - 1)
+			}
+			sizes[i] = size
+			data = data[consumed:]
+		}
+	}
+
+	laces := make([][]byte, 0, n)
+	for _, size := range sizes {
+		if size > uint64(len(data)) {
+			return nil, errors.New("malformed lacing")
+		}
+		laces = append(laces, data[:size])
+		data = data[size:]
+	}
+	return append(laces, data), nil
+}
+
+// Encode a tag with given contents. The length is always 8 bytes long, which is a bit
+// wasteful, but these are only used for rarely sent stuff like track info anyway.
+func ebmlTagBytes(id uint, contents []byte) []byte {
+	buf := make([]byte, 0, 12+len(contents))
+	for shift := uint(24); shift != 0; shift -= 8 {
+		if id >= 1<<shift {
+			buf = append(buf, byte(id>>shift))
+		}
+	}
+	n := uint64(len(contents))
+	buf = append(buf, byte(id), 0x01,
+		byte(n>>48), byte(n>>40), byte(n>>32), byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	return append(buf, contents...)
+}
+
+// Encode an unsigned integer tag. Like `ebmlTagBytes`, this is not the most compact way.
+func ebmlUintBytes(id uint, x uint64) []byte {
+	buf := make([]byte, 8)
+	putFixedUint(buf, x)
+	return ebmlTagBytes(id, buf)
+}
+
+// Write a big-endian number into a fixed-width field. Fails if it does not fit.
+func putFixedUint(data []byte, x uint64) bool {
+	for i := len(data) - 1; i >= 0; i-- {
+		data[i], x = byte(x), x>>8
+	}
+	return x == 0
+}
+
 type frame struct {
 	buf   []byte // Either a Block(Group) or a Cluster.
-	track uint64 // 64 for a Cluster (track masks are 32-bit, so streams with a real 64-th track are rejected)
+	track uint64 // 64 for a Cluster (track masks are 64-bit, so streams with a real 64-th track are rejected)
 	key   bool
 }
 
@@ -149,6 +349,23 @@ type framebuffer struct {
 	data        []frame
 	start       int
 	headCluster []byte // Last Cluster popped off the ring. Blocks at the head still belong to it.
+	// The last keyframe of each track, oldest first, each preceded by its Cluster.
+	// Only filled if `Broadcast.CacheKeyframes` is set.
+	keyframes []frame
+}
+
+func (fb *framebuffer) PushKeyframe(cluster []byte, packed frame) {
+	for i := 0; i < len(fb.keyframes); i += 2 {
+		if fb.keyframes[i+1].track == packed.track {
+			fb.keyframes = append(fb.keyframes[:i], fb.keyframes[i+2:]...)
+			break
+		}
+	}
+	fb.keyframes = append(fb.keyframes, frame{cluster, 64, false}, packed)
+}
+
+func (fb *framebuffer) Reset() {
+	fb.data, fb.start, fb.headCluster, fb.keyframes = fb.data[:0], 0, nil, nil
 }
 
 func (fb *framebuffer) PushCluster(buf []byte) {
@@ -167,18 +384,40 @@ func (fb *framebuffer) PushFrame(packed frame) {
 	}
 }
 
-func (fb *framebuffer) Read(cb func(cluster []byte, forceCluster bool, packed frame)) {
+// Pass the buffered frames to a callback. Returns the tracks for which only a cached
+// keyframe was sent; nothing else on them can be decoded until the next keyframe.
+func (fb *framebuffer) Read(cb func(cluster []byte, forceCluster bool, packed frame)) uint64 {
+	// Keyframes that are no longer in the ring are older than anything in it, so they
+	// can go first. The frames in between are lost, so the ones that follow in the ring
+	// do not reference the cached keyframe and are skipped.
+	stale := uint64(0)
+	for i := 0; i < len(fb.keyframes); i += 2 {
+		if key := fb.keyframes[i+1]; !fb.hasKeyframe(key.track) {
+			cb(fb.keyframes[i].buf, true, key)
+			stale |= 1 << key.track
+		}
+	}
 	cluster, forceCluster := fb.headCluster, true
 	for i, s, n := 0, fb.start, len(fb.data); i < n; i++ {
 		f := fb.data[(i+s)%n]
 		if f.track == 64 {
 			cluster = f.buf
 			forceCluster = true
-		} else if cluster != nil {
+		} else if cluster != nil && stale&(1<<f.track) == 0 {
 			cb(cluster, forceCluster, f)
 			forceCluster = false
 		}
 	}
+	return stale
+}
+
+func (fb *framebuffer) hasKeyframe(track uint64) bool {
+	for _, f := range fb.data {
+		if f.key && f.track == track {
+			return true
+		}
+	}
+	return false
 }
 
 type viewer struct {
@@ -186,53 +425,265 @@ type viewer struct {
 	// The stream will resynchronize at next keyframe.
 	write func(data []byte) bool
 	// Viewers may hop between streams, but should only receive headers once.
-	// This includes track info, as codecs must stay the same between segments.
+	// This includes track info, unless a new segment has different tracks, in which
+	// case the headers are sent again and the decoder has to reinitialize.
 	skipHeaders bool
 	// We group blocks into indeterminate-length clusters. So long as
 	// the cluster's timecode has not changed, there's no need to start a new one.
 	skipCluster bool
 	// Bit vector of tracks for which the viewer has both reference frames
 	// (the previous frame and the last keyframe.)
-	seenKeyframes uint32
+	seenKeyframes uint64
+	// How many times `write` returned `false`.
+	dropped uint64
+	// Bit vector of tracks that the viewer wants to receive.
+	tracks uint64
+	// Whether the end-of-stream marker has been sent already.
+	ended bool
+	// Whether to skip all blocks that are not keyframes (see `Broadcast.KeyframesOnly`.)
+	keyframesOnly bool
+	// The number of consecutive times `write` returned `false`.
+	stalls int
+	// If nonzero, the most bytes per second this viewer may receive on average
+	// (see `Broadcast.Throttle`.) `allowance` is how many it may receive right now;
+	// it grows with time, up to a second's worth, and may go negative after a large
+	// chunk, in which case everything is dropped until it recovers.
+	rate      float64
+	allowance float64
+	refilled  time.Time
+}
+
+// Whether a chunk of `n` bytes would exceed the rate limit; if not, it's accounted for.
+func (cb *viewer) throttled(n int, now time.Time) bool {
+	if cb.rate == 0 || n == 0 {
+		return false
+	}
+	cb.allowance += cb.rate * now.Sub(cb.refilled).Seconds()
+	cb.refilled = now
+	if cb.allowance > cb.rate {
+		cb.allowance = cb.rate
+	}
+	if cb.allowance < 0 {
+		return true
+	}
+	// Always letting a chunk through while there's any allowance left means even
+	// keyframes larger than a second's worth of data eventually get sent.
+	cb.allowance -= float64(n)
+	return false
+}
+
+// Signal the end of the stream with an empty chunk.
+func (cb *viewer) end() {
+	if !cb.ended {
+		cb.ended = true
+		cb.write([]byte{})
+	}
 }
 
 func (cb *viewer) WriteFrame(cluster []byte, forceCluster bool, packed frame) {
-	trackMask := uint32(1) << packed.track
+	trackMask := uint64(1) << packed.track
 	if forceCluster {
 		cb.skipCluster = false
 	}
+	if cb.tracks&trackMask == 0 || cb.keyframesOnly && !packed.key {
+		return
+	}
 	if packed.key {
 		cb.seenKeyframes |= trackMask
 	}
 	if cb.seenKeyframes&trackMask != 0 {
+		data := packed.buf
 		if !cb.skipCluster {
-			cb.skipCluster = cb.write(cluster)
+			// A single chunk, so that the viewer never gets a cluster without blocks
+			// if its buffer fills up in between.
+			data = append(append(make([]byte, 0, len(cluster)+len(data)), cluster...), data...)
 		}
-		if !cb.skipCluster || !cb.write(packed.buf) {
+		if cb.write(data) {
+			cb.skipCluster = true
+		} else {
 			cb.seenKeyframes &= ^trackMask
 		}
 	}
 }
 
+func sameTracks(a []TrackInfo, b []TrackInfo) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// A source of time for `BroadcastSet`, so that timeouts can be tested without waiting.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+type realClock struct{}
+type realTicker struct{ *time.Ticker }
+
+func (realClock) Now() time.Time                   { return time.Now() }
+func (realClock) NewTicker(d time.Duration) Ticker { return realTicker{time.NewTicker(d)} }
+func (t realTicker) C() <-chan time.Time           { return t.Ticker.C }
+
+type CloseReason int
+
+const (
+	// The broadcaster has disconnected (see `Broadcast.Close`) and did not come back
+	// within `Timeout`.
+	CloseTimeout CloseReason = iota
+	// Nothing has been written for `IdleTimeout`, nor during the `Timeout` after that.
+	CloseIdle
+	// `BroadcastSet.Shutdown` was called.
+	CloseShutdown
+	// The stream has been live for longer than `MaxStreamDuration`.
+	CloseDurationLimit
+)
+
+func (r CloseReason) String() string {
+	switch r {
+	case CloseTimeout:
+		return "timeout"
+	case CloseIdle:
+		return "idle"
+	case CloseShutdown:
+		return "shutdown"
+	case CloseDurationLimit:
+		return "duration limit"
+	}
+	return "unknown"
+}
+
+type sharedHeader struct {
+	data []byte // (Never modified.)
+	refs int
+}
+
 type BroadcastSet struct {
-	mutex   sync.Mutex
-	streams map[string]*Broadcast
+	mutex    sync.Mutex
+	streams  map[string]*Broadcast
+	shutdown chan struct{} // (Closed by `Shutdown`.)
+	stopped  bool
+	running  sync.WaitGroup
+	// EBML headers of all streams, by contents. They are mostly the same, so there's
+	// no need to keep a copy for each stream. (See `internHeader`.)
+	headers map[string]*sharedHeader
 	// How long to keep a stream alive after a call to `Close`.
 	Timeout time.Duration
+	// If nonzero, streams that receive no data for this long are closed as if
+	// the broadcaster has disconnected.
+	IdleTimeout time.Duration
+	// If nonzero, streams are destroyed this long after being created, without waiting
+	// for `Timeout`. Reconnecting before then does not reset this.
+	MaxStreamDuration time.Duration
+	// How often to update bitrate estimates and check the timeouts. Default is 1s.
+	TickInterval time.Duration
+	// If nonzero, `Writable` refuses to create new streams while there are this many
+	// already, including closed ones that have not timed out yet.
+	MaxStreams int
+	// Where `Created`, `Stats().Uptime`, and the timeouts get the time from. Default
+	// is the system clock.
+	Clock Clock
+	// Called from `Write` once the first block of a new stream arrives. Reconnecting
+	// to a stream that has not timed out yet does not count.
+	OnStreamStart func(id string)
 	// Called right after a stream is destroyed. (`Timeout` seconds after a `Close`.)
-	OnStreamClose     func(id string)
+	OnStreamClose func(id string)
+	// Same, but also says why. Called right before `OnStreamClose`.
+	OnStreamCloseReason func(id string, reason CloseReason)
+	// Called when `WritableForce` kicks out a writer. The stream goes on, so this is
+	// not followed by `OnStreamClose`.
+	OnStreamEvict     func(id string)
 	OnStreamTrackInfo func(id string, info *StreamTrackInfo)
+	// Called when `Write` rejects the data (the error is still returned, too.)
+	OnStreamError func(id string, err error)
 }
 
 type Broadcast struct {
+	// The number of chunks not sent to viewers because their buffers were full, summed
+	// over all viewers. Accessed atomically, thus must stay first for 64-bit alignment.
+	DroppedFrames uint64
+	// How long ago `Close` was called (in nanoseconds, updated every tick), or -1 if the
+	// stream is live. Also accessed atomically.
+	closing int64
+	// Why the stream was closed last, as a `CloseReason`. Also accessed atomically.
+	closeReason int32
 	StreamTrackInfo
-	closing time.Duration
-	Closed  bool
-	dirty   bool // (Has unseen data in `StreamTrackInfo`.)
+	// From the current segment's `Info`, if the encoder has set them. Not used for
+	// anything, but they help figure out what the broadcaster is running.
+	MuxingApp  string
+	WritingApp string
+	DateUTC    time.Time // (Zero if absent.)
+	// The largest tag (including its header) accepted by `Write`. Default is 1 MiB,
+	// which may be too little for keyframes of high-bitrate streams.
+	MaxBlockSize uint64
+	// If not empty, `Write` rejects segments with tracks whose `CodecID` is not one
+	// of these (e.g. "V_VP8", "A_OPUS"), so that viewers never get what they can't play.
+	AllowedCodecs []string
+	// Called from `Write` for each keyframe of a video track, e.g. to make thumbnails.
+	// The data is the frame itself (as passed to the decoder; laced blocks result in
+	// one call per frame), and it must not be modified. As this blocks the stream,
+	// anything slow should be done asynchronously.
+	OnKeyframe func(track uint, timecode uint64, data []byte)
+	// Keep the last keyframe of each track even after it falls out of the buffer of
+	// recent frames, and send it to new viewers first so that they don't have to wait
+	// for the next one. Useful for streams with long keyframe intervals.
+	CacheKeyframes bool
+	// Called from `Write` when a new segment has a different resolution or set of
+	// media types than the previous one, e.g. to update the displayed resolution.
+	// Not called for the first segment.
+	OnMetadataChange func()
+	Created          time.Time
+	// What to do with viewers whose buffers are full. With `SlowViewerDisconnect`,
+	// a viewer is dropped after more than `SlowViewerThreshold` failed writes in a row.
+	SlowViewerStrategy  SlowViewerStrategy
+	SlowViewerThreshold int
+	// `Healthy` wants a block within the last `HealthTimeout` (default 5s) and
+	// the bitrate's standard deviation to be at most `HealthMaxDeviation` (default 1)
+	// times its mean.
+	HealthTimeout      time.Duration
+	HealthMaxDeviation float64
+
+	Closed bool
+	// Held during `Write`, so that `WritableForce` can wait for the old writer to finish
+	// before handing the parser over to the new one.
+	wlock     sync.Mutex
+	evicted   chan struct{} // (Closed when the current writer is replaced by `WritableForce`.)
+	destroyed bool          // (Removed from the set, so `Write` only returns `ErrStreamEnded`.)
+	onError   func(err error)
+	onStart   func()
+	// (Set by `BroadcastSet` to share headers between streams.)
+	intern  func(old []byte, data []byte) []byte
+	dirty   bool // (`StreamTrackInfo` has changed since it was copied into `info`.)
+	started bool // (Has received at least one block. Only accessed by `Write`.)
 	buffer  []byte
 	header  []byte // The EBML (DocType) tag.
-	tracks  []byte // The beginning of the Segment (Tracks + Info).
-	frames  framebuffer
+	// Whether `header` has been replaced, so viewers should get it again.
+	headerChanged bool
+	tracks        []byte // The beginning of the Segment (Tracks + Info).
+	frames        framebuffer
+	// Tracks of the segment whose blocks are currently being sent to viewers.
+	sentTracks []TrackInfo
+	// Bit vectors of tracks that contain audio/video. (Width & height are only set
+	// by video tracks, so in an audio-only stream they stay zero.)
+	audioTracks uint64
+	videoTracks uint64
+	// All tracks that have a `TrackEntry` in the current segment.
+	declaredTracks uint64
+	// What `OnMetadataChange` compares against; only the dimensions and `Has*` are set.
+	// Nothing to compare against until the first segment has a block.
+	lastShape StreamTrackInfo
+	haveShape bool
 	// outbound clusters must have monotonically increasing timecodes even if the inbound
 	// stream restarts from the beginning.
 	firstBlockInSegment bool
@@ -240,15 +691,36 @@ type Broadcast struct {
 	sentClusterTimecode uint64
 	recvClusterTimecode uint64
 	timecodeShift       uint64
+	// inbound timecodes are converted to milliseconds, as that's what the above logic uses.
+	timecodeScale   uint64 // Nanoseconds per unit of inbound timecodes; 0 means 1000000.
+	clusterTimecode uint64 // As received, in units of `timecodeScale`.
+	clock           Clock
+	lock            sync.Mutex // (Guards the seven fields below.)
+	lastWrite       time.Time
+	lastBlock       time.Time
 	// these values are for the whole stream, so they include audio and muxing overhead.
 	// the latter is negligible, however, and the former is normally about 64k,
 	// so also negligible. or at least predictable.
-	rateUnit float64
-	RateMean float64
+	rateUnit float64 // Bytes received since the last tick.
+	RateMean float64 // In bytes per second.
 	RateVar  float64
+	// A copy of `StreamTrackInfo` for everyone but the writer, updated after each
+	// `Write` that changes it, so that nobody sees a half-parsed segment.
+	info        StreamTrackInfo
+	infoChanged bool // (Not yet passed to `OnStreamTrackInfo`.)
 
 	vlock   sync.Mutex
 	viewers map[chan<- []byte]*viewer
+	paused  bool
+	resumed bool // (Until `Write` drops the frames from before the `Pause`.)
+	// A viewer that writes the stream to a file instead of a socket.
+	recording     chan<- []byte
+	recordingDone chan struct{}
+	recordingErr  error
+	recordingCues *cueIndex
+	// Callbacks added by `Tap`, by an arbitrary ID.
+	taps    map[int]BlockTap
+	nextTap int
 }
 
 func (ctx *BroadcastSet) Readable(id string) (*Broadcast, bool) {
@@ -261,82 +733,383 @@ func (ctx *BroadcastSet) Readable(id string) (*Broadcast, bool) {
 	return cast, ok
 }
 
+// Same as `Readable`, but not for streams that have been closed and are waiting for
+// the broadcaster to come back; new viewers would likely only get the end of stream.
+func (ctx *BroadcastSet) ReadableLive(id string) (*Broadcast, bool) {
+	cast, ok := ctx.Readable(id)
+	if !ok || cast.IsClosing() {
+		return nil, false
+	}
+	return cast, true
+}
+
+func newBroadcast(clock Clock) *Broadcast {
+	return &Broadcast{
+		closing:             -1,
+		clock:               clock,
+		evicted:             make(chan struct{}),
+		frames:              framebuffer{make([]frame, 0, 120), 0, nil, nil},
+		viewers:             make(map[chan<- []byte]*viewer),
+		sentClusterTimecode: 0xFFFFFFFFFFFFFFFF,
+		Created:             clock.Now(),
+		lastWrite:           clock.Now(),
+	}
+}
+
+// IDs of all streams in the set. The value is `true` for live ones and `false` for those
+// that have been closed but not yet destroyed (see `Timeout`.)
+func (ctx *BroadcastSet) Active() map[string]bool {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+	ids := make(map[string]bool, len(ctx.streams))
+	for id, cast := range ctx.streams {
+		ids[id] = !cast.IsClosing()
+	}
+	return ids
+}
+
+// Stop using the `old` header (if not nil) and return a copy of `data` shared with
+// all other streams that have the same one (or nil if `data` is nil).
+func (ctx *BroadcastSet) internHeader(old []byte, data []byte) []byte {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+	if h, ok := ctx.headers[string(old)]; ok && old != nil {
+		if h.refs--; h.refs == 0 {
+			delete(ctx.headers, string(old))
+		}
+	}
+	if data == nil {
+		return nil
+	}
+	if ctx.headers == nil {
+		ctx.headers = make(map[string]*sharedHeader)
+	}
+	h, ok := ctx.headers[string(data)]
+	if !ok {
+		h = &sharedHeader{data: append([]byte{}, data...)}
+		ctx.headers[string(h.data)] = h
+	}
+	h.refs++
+	return h.data
+}
+
+// Whether `MaxStreams` has been reached, so `Writable` only reopens existing streams.
+func (ctx *BroadcastSet) Full() bool {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+	return ctx.MaxStreams != 0 && len(ctx.streams) >= ctx.MaxStreams
+}
+
 func (ctx *BroadcastSet) Writable(id string) (*Broadcast, bool) {
+	cast, _, ok := ctx.writable(id)
+	return cast, ok
+}
+
+// Same as `Writable`, but also return the `Evicted` channel for this writer.
+func (ctx *BroadcastSet) writable(id string) (*Broadcast, <-chan struct{}, bool) {
 	ctx.mutex.Lock()
 	defer ctx.mutex.Unlock()
+	if ctx.stopped {
+		return nil, nil, false
+	}
 	if ctx.streams == nil {
 		ctx.streams = make(map[string]*Broadcast)
+		ctx.shutdown = make(chan struct{})
 	}
 	if cast, ok := ctx.streams[id]; ok {
-		if cast.closing == -1 {
-			return nil, false
+		if !cast.IsClosing() {
+			return nil, nil, false
 		}
-		cast.closing = -1
-		return cast, true
+		atomic.StoreInt64(&cast.closing, -1)
+		cast.lock.Lock()
+		cast.lastWrite = cast.clock.Now()
+		cast.lock.Unlock()
+		return cast, cast.evicted, true
 	}
-	cast := Broadcast{
-		closing:             -1,
-		frames:              framebuffer{make([]frame, 0, 120), 0, nil},
-		viewers:             make(map[chan<- []byte]*viewer),
-		sentClusterTimecode: 0xFFFFFFFFFFFFFFFF,
+	if ctx.MaxStreams != 0 && len(ctx.streams) >= ctx.MaxStreams {
+		return nil, nil, false
+	}
+	clock := ctx.Clock
+	if clock == nil {
+		clock = realClock{}
+	}
+	cast := newBroadcast(clock)
+	cast.onError = func(err error) {
+		if ctx.OnStreamError != nil {
+			ctx.OnStreamError(id, err)
+		}
+	}
+	cast.onStart = func() {
+		if ctx.OnStreamStart != nil {
+			ctx.OnStreamStart(id)
+		}
 	}
-	ctx.streams[id] = &cast
+	cast.intern = ctx.internHeader
+	ctx.streams[id] = cast
+	ctx.running.Add(1)
 	go func() {
-		ticker := time.NewTicker(time.Second)
-		for range ticker.C {
-			if cast.dirty {
-				cast.dirty = false
-				ctx.OnStreamTrackInfo(id, &cast.StreamTrackInfo)
-			}
-			if cast.closing >= 0 {
-				if cast.closing += time.Second; cast.closing > ctx.Timeout {
-					break
+		defer ctx.running.Done()
+		interval := ctx.TickInterval
+		if interval <= 0 {
+			interval = time.Second
+		}
+		// Older samples lose half their weight every second, however often they're taken.
+		a := 1 - math.Pow(0.5, interval.Seconds())
+		ticker := clock.NewTicker(interval)
+		reason := CloseShutdown
+	loop:
+		for {
+			select {
+			case <-ctx.shutdown:
+				break loop
+			case <-ticker.C():
+			}
+			cast.lock.Lock()
+			info, changed := cast.info, cast.infoChanged
+			cast.infoChanged = false
+			cast.lock.Unlock()
+			if changed {
+				ctx.OnStreamTrackInfo(id, &info)
+			}
+			// (If this fails, the stream has been reopened or closed again meanwhile.)
+			if c := atomic.LoadInt64(&cast.closing); c >= 0 && atomic.CompareAndSwapInt64(&cast.closing, c, c+int64(interval)) {
+				if time.Duration(c)+interval > ctx.Timeout {
+					reason = CloseReason(atomic.LoadInt32(&cast.closeReason))
+					break loop
 				}
 			}
-			// exponentially weighted moving moments at a = 0.5
+			// exponentially weighted moving moments
 			//     avg[n] = a * x + (1 - a) * avg[n - 1]
-			//     var[n] = a * (x - avg[n]) ** 2 / (1 - a) + (1 - a) * var[n - 1]
-			cast.RateMean += cast.rateUnit / 2
-			cast.RateVar += cast.rateUnit*cast.rateUnit - cast.RateVar/2
-			cast.rateUnit = -cast.RateMean
+			//     var[n] = (1 - a) * (var[n - 1] + a * (x - avg[n - 1]) ** 2)
+			cast.lock.Lock()
+			d := cast.rateUnit/interval.Seconds() - cast.RateMean
+			cast.RateMean += a * d
+			cast.RateVar = (1 - a) * (cast.RateVar + a*d*d)
+			cast.rateUnit = 0
+			idle := clock.Now().Sub(cast.lastWrite)
+			cast.lock.Unlock()
+			if ctx.IdleTimeout != 0 && !cast.IsClosing() && idle > ctx.IdleTimeout {
+				cast.close(CloseIdle)
+			}
+			if ctx.MaxStreamDuration != 0 && clock.Now().Sub(cast.Created) > ctx.MaxStreamDuration {
+				reason = CloseDurationLimit
+				break loop
+			}
 		}
 		ticker.Stop()
 
+		// The broadcaster may still be writing, e.g. if `MaxStreamDuration` has been
+		// reached; it should stop instead of touching the set's shared headers.
+		cast.wlock.Lock()
+		cast.destroyed = true
+		cast.wlock.Unlock()
 		ctx.mutex.Lock()
 		delete(ctx.streams, id)
 		ctx.mutex.Unlock()
 		cast.Closed = true
 		cast.vlock.Lock()
 		for _, cb := range cast.viewers {
-			cb.write([]byte{})
+			cb.end()
 		}
+		header := cast.header
 		cast.vlock.Unlock()
+		ctx.internHeader(header, nil)
+		if ctx.OnStreamCloseReason != nil {
+			ctx.OnStreamCloseReason(id, reason)
+		}
 		if ctx.OnStreamClose != nil {
 			ctx.OnStreamClose(id)
 		}
 	}()
-	return &cast, true
+	return cast, cast.evicted, true
+}
+
+// Destroy all streams right away, as if they all timed out, and wait until they're gone
+// (i.e. `OnStreamClose` has returned for each) or the context expires. Afterwards,
+// `Writable` always fails.
+func (ctx *BroadcastSet) Shutdown(c context.Context) error {
+	ctx.mutex.Lock()
+	if !ctx.stopped {
+		ctx.stopped = true
+		if ctx.shutdown != nil {
+			close(ctx.shutdown)
+		}
+	}
+	ctx.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		ctx.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-c.Done():
+		return c.Err()
+	}
+}
+
+// Same as `Writable`, but if the stream is already being written to, the previous
+// writer is kicked out instead of this one. Viewers stay connected and resynchronize
+// at the next keyframe. The channel is closed once this writer is kicked out in turn;
+// until then, it's the same as `Evicted`, but unlike that, it can't belong to someone
+// who came after.
+func (ctx *BroadcastSet) WritableForce(id string) (*Broadcast, <-chan struct{}, bool) {
+	ctx.mutex.Lock()
+	cast, ok := ctx.streams[id]
+	ctx.mutex.Unlock()
+	if ok {
+		// `Write` takes `ctx.mutex` to intern headers, so this must go first.
+		cast.wlock.Lock()
+		ctx.mutex.Lock()
+		if ctx.streams[id] == cast && !cast.IsClosing() {
+			cast.vlock.Lock()
+			close(cast.evicted)
+			cast.evicted = make(chan struct{})
+			evicted := cast.evicted
+			for _, cb := range cast.viewers {
+				cb.seenKeyframes = 0
+			}
+			cast.vlock.Unlock()
+			cast.lock.Lock()
+			cast.lastWrite = cast.clock.Now()
+			cast.lock.Unlock()
+			cast.buffer = nil
+			ctx.mutex.Unlock()
+			cast.wlock.Unlock()
+			if ctx.OnStreamEvict != nil {
+				ctx.OnStreamEvict(id)
+			}
+			return cast, evicted, true
+		}
+		ctx.mutex.Unlock()
+		cast.wlock.Unlock()
+	}
+	return ctx.writable(id)
+}
+
+// A channel that is closed once someone else takes over the stream via `WritableForce`.
+// After that, the old writer must neither `Write` nor `Close`.
+func (cast *Broadcast) Evicted() <-chan struct{} {
+	cast.vlock.Lock()
+	defer cast.vlock.Unlock()
+	return cast.evicted
 }
 
 func (cast *Broadcast) Close() error {
-	cast.closing = 0
+	cast.close(CloseTimeout)
 	return nil
 }
 
-func (cast *Broadcast) Connect(ch chan<- []byte, skipHeaders bool) {
+func (cast *Broadcast) close(reason CloseReason) {
+	atomic.StoreInt32(&cast.closeReason, int32(reason))
+	atomic.StoreInt64(&cast.closing, 0)
+}
+
+// Whether the stream has been closed and will be destroyed once `Timeout` passes,
+// unless the broadcaster reconnects.
+func (cast *Broadcast) IsClosing() bool {
+	return atomic.LoadInt64(&cast.closing) >= 0
+}
+
+// Start sending the stream to a channel. Blocks of tracks not in `trackMask`
+// (bit `1 << n` for track number `n`) are withheld, e.g. to provide an audio-only view,
+// though the headers still describe all of them.
+//
+// A zero-length chunk means the stream has ended; it is sent once, and nothing follows.
+// (Like anything else, it is dropped if the channel is full, so check `Closed` too.)
+func (cast *Broadcast) Connect(ch chan<- []byte, skipHeaders bool, trackMask uint64) {
+	cb := cast.newViewer(ch, skipHeaders, trackMask)
+	cast.vlock.Lock()
+	cast.viewers[ch] = cb
+	cast.vlock.Unlock()
+}
+
+// A viewer that writes into a channel, not yet connected.
+func (cast *Broadcast) newViewer(ch chan<- []byte, skipHeaders bool, trackMask uint64) *viewer {
 	blocked := false
-	write := func(data []byte) bool {
+	cb := &viewer{skipHeaders: skipHeaders, tracks: trackMask}
+	cb.write = func(data []byte) bool {
+		if cb.throttled(len(data), cast.clock.Now()) {
+			// Not the viewer's fault, so `SlowViewerDisconnect` should not apply.
+			cb.dropped++
+			return false
+		}
 		// `Broadcast.Write` emits data in block-sized chunks.
 		// Thus the buffer size is measured in frames, not bytes.
 		blocked = len(ch) == cap(ch) || (blocked && len(ch)*2 >= cap(ch))
 		if !blocked {
 			ch <- data
+			cb.stalls = 0
+		} else {
+			cb.stalls++
+			cb.dropped++
+			atomic.AddUint64(&cast.DroppedFrames, 1)
 		}
 		return !blocked
 	}
+	return cb
+}
+
+// Called with each block of a stream, in the same order viewers get them. `timecode`
+// is absolute, in milliseconds, and never goes back even if the broadcaster restarts
+// the stream, though blocks with B-frames may be out of order within a cluster.
+// `block` is the whole `SimpleBlock` or `BlockGroup` and must not be modified.
+type BlockTap func(track uint, keyframe bool, timecode uint64, block []byte)
+
+// Receive the blocks of the stream as they arrive, e.g. to remux them into another
+// format, without parsing WebM again. Headers are not included; `Tracks` describes
+// the blocks by the time the first of them arrives, and after a change of codecs,
+// by the time the first block of the new segment does. Nothing is sent while the
+// stream is paused. The callback is invoked from `Write`, so it blocks the stream,
+// but may call methods of the `Broadcast` other than `Write`. Returns a function
+// that removes it.
+func (cast *Broadcast) Tap(cb BlockTap) (untap func()) {
+	cast.vlock.Lock()
+	if cast.taps == nil {
+		cast.taps = make(map[int]BlockTap)
+	}
+	id := cast.nextTap
+	cast.nextTap++
+	cast.taps[id] = cb
+	cast.vlock.Unlock()
+	return func() {
+		cast.vlock.Lock()
+		delete(cast.taps, id)
+		cast.vlock.Unlock()
+	}
+}
 
+// Same as `Connect`, but `Disconnect` automatically once the context is done.
+// (Until then, a goroutine waits for it, so it should be done eventually.)
+func (cast *Broadcast) ConnectContext(c context.Context, ch chan<- []byte, skipHeaders bool, trackMask uint64) {
+	cast.Connect(ch, skipHeaders, trackMask)
+	go func() {
+		<-c.Done()
+		cast.Disconnect(ch)
+	}()
+}
+
+// Limit a connected viewer to `bytesPerSecond` on average (or remove the limit, if 0).
+// Chunks that would exceed it are skipped as if the channel was full, so the viewer
+// waits for the next keyframe instead of falling behind.
+func (cast *Broadcast) Throttle(ch chan<- []byte, bytesPerSecond float64) {
 	cast.vlock.Lock()
-	cast.viewers[ch] = &viewer{write: write}
+	if cb, ok := cast.viewers[ch]; ok {
+		cb.rate, cb.allowance, cb.refilled = bytesPerSecond, bytesPerSecond, cast.clock.Now()
+	}
+	cast.vlock.Unlock()
+}
+
+// Send a connected viewer only keyframes (or everything again, if `false`), e.g. for
+// a low-bandwidth preview. Audio blocks are all keyframes, so they are still sent;
+// use a `trackMask` to withhold them too.
+func (cast *Broadcast) KeyframesOnly(ch chan<- []byte, on bool) {
+	cast.vlock.Lock()
+	if cb, ok := cast.viewers[ch]; ok {
+		cb.keyframesOnly = on
+	}
 	cast.vlock.Unlock()
 }
 
@@ -346,12 +1119,453 @@ func (cast *Broadcast) Disconnect(ch chan<- []byte) {
 	cast.vlock.Unlock()
 }
 
+// The number of channels currently attached via `Connect`, regardless of whether
+// there's anyone in the chat.
+func (cast *Broadcast) ViewerCount() int {
+	cast.vlock.Lock()
+	defer cast.vlock.Unlock()
+	return len(cast.viewers)
+}
+
+type SlowViewerStrategy int
+
+const (
+	// Skip frames until the next keyframe, hoping the viewer catches up by then.
+	SlowViewerResync SlowViewerStrategy = iota
+	// Remove the viewer and close its channel.
+	SlowViewerDisconnect
+)
+
+type BroadcastStats struct {
+	Bitrate  float64 // bits per second, averaged over the last few seconds
+	Viewers  int
+	Uptime   time.Duration
+	HasVideo bool
+	HasAudio bool
+}
+
+// An estimate of the incoming bitrate in bits per second. This is an exponentially
+// weighted moving average with a half-life of 1 second (see `TickInterval`), so it
+// follows sudden changes pretty quickly while ignoring noise like keyframes.
+func (cast *Broadcast) BitrateBPS() float64 {
+	cast.lock.Lock()
+	defer cast.lock.Unlock()
+	return cast.RateMean * 8
+}
+
+// Whether the stream is live and blocks arrive at a steady rate (see `HealthTimeout`
+// and `HealthMaxDeviation`.) If not for a while, the encoder may need a restart.
+func (cast *Broadcast) Healthy() bool {
+	if cast.IsClosing() {
+		return false
+	}
+	timeout := cast.HealthTimeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	deviation := cast.HealthMaxDeviation
+	if deviation == 0 {
+		deviation = 1
+	}
+	cast.lock.Lock()
+	defer cast.lock.Unlock()
+	if cast.lastBlock.IsZero() || cast.clock.Now().Sub(cast.lastBlock) > timeout {
+		return false
+	}
+	return cast.RateMean > 0 && math.Sqrt(cast.RateVar) <= deviation*cast.RateMean
+}
+
+// A consistent snapshot of the stream's state, unlike reading `RateMean` & co. directly.
+func (cast *Broadcast) Stats() BroadcastStats {
+	cast.lock.Lock()
+	hasVideo, hasAudio := cast.info.HasVideo, cast.info.HasAudio
+	cast.lock.Unlock()
+	return BroadcastStats{
+		Bitrate:  cast.BitrateBPS(),
+		Viewers:  cast.ViewerCount(),
+		Uptime:   cast.clock.Now().Sub(cast.Created),
+		HasVideo: hasVideo,
+		HasAudio: hasAudio,
+	}
+}
+
+// Save the stream, exactly as viewers see it, into a file. Since the recorder is just
+// another viewer, it starts at a keyframe, with headers, so the result is a valid WebM.
+// Recording continues until either `StopRecording` or the end of the stream
+// (that is, its destruction, not `Close` -- the broadcaster may yet reconnect.)
+func (cast *Broadcast) StartRecording(w io.Writer) error {
+	ch := make(chan []byte, 480)
+	cb := cast.newViewer(ch, false, ^uint64(0))
+
+	cast.vlock.Lock()
+	if cast.recording != nil {
+		cast.vlock.Unlock()
+		return errors.New("already recording")
+	}
+	done := make(chan struct{})
+	index := &cueIndex{}
+	// (Connected under the same lock so that `Write` can't send anything to a viewer
+	// that is about to be thrown away, nor `StopRecording` miss it.)
+	cast.viewers[ch] = cb
+	cast.recording, cast.recordingDone, cast.recordingErr, cast.recordingCues = ch, done, nil, index
+	cast.vlock.Unlock()
+
+	go func() {
+		var err error
+		for chunk := range ch {
+			if len(chunk) == 0 {
+				break // The stream is no more.
+			}
+			if err == nil {
+				_, err = w.Write(index.process(chunk))
+			}
+		}
+		cast.recordingErr = err
+		close(done)
+	}()
+	return nil
+}
+
+// Wait until everything has been written, then return the first error the writer
+// returned, if any.
+func (cast *Broadcast) StopRecording() error {
+	cast.vlock.Lock()
+	ch, done := cast.recording, cast.recordingDone
+	cast.recording, cast.recordingDone = nil, nil
+	// If the recorder was too slow, the channel is already closed.
+	_, connected := cast.viewers[ch]
+	delete(cast.viewers, ch)
+	cast.vlock.Unlock()
+
+	if ch == nil {
+		return errors.New("not recording")
+	}
+	if connected {
+		close(ch)
+	}
+	<-done
+	return cast.recordingErr
+}
+
+// Make a finished recording seekable by appending a `Cues` element (an index of
+// clusters that start with keyframes) and pointing a `SeekHead` at it. `w` must be
+// the (initially empty) file given to `StartRecording`, and `StopRecording` must have
+// returned. If the headers changed midway, only the last Segment is indexed.
+func (cast *Broadcast) FinalizeCues(w io.WriteSeeker) error {
+	cast.vlock.Lock()
+	recording, index := cast.recording != nil, cast.recordingCues
+	cast.vlock.Unlock()
+	if recording {
+		return errors.New("still recording")
+	}
+	if index == nil || index.segment == 0 {
+		return errors.New("nothing recorded")
+	}
+
+	points := []byte{}
+	for _, p := range index.points {
+		pos := append(ebmlUintBytes(ebmlTagCueTrack, p.track), ebmlUintBytes(ebmlTagCueClusterPos, uint64(p.cluster))...)
+		points = append(points, ebmlTagBytes(ebmlTagCuePoint,
+			append(ebmlUintBytes(ebmlTagCueTime, p.time), ebmlTagBytes(ebmlTagCueTrackPos, pos)...))...)
+	}
+	cues := ebmlTagBytes(ebmlTagCues, points)
+	if _, err := w.Seek(index.offset, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := w.Write(cues); err != nil {
+		return err
+	}
+
+	// The Segment now has a known length, stored in the 8 bytes right before its
+	// contents, which start with a Void reserved for the SeekHead.
+	seek := append(ebmlTagBytes(ebmlTagSeekID, []byte{0x1C, 0x53, 0xBB, 0x6B}),
+		ebmlUintBytes(ebmlTagSeekPosition, uint64(index.offset-index.segment))...)
+	head := make([]byte, 8, 8+cueReserved)
+	head[0] = 0x01
+	putFixedUint(head[1:], uint64(index.offset+int64(len(cues))-index.segment))
+	head = append(head, ebmlTagBytes(ebmlTagSeekHead, ebmlTagBytes(ebmlTagSeek, seek))...)
+	head = append(head, ebmlTagVoid, 0x80|byte(8+cueReserved-len(head)-2))
+	head = append(head, make([]byte, 8+cueReserved-len(head))...)
+	if _, err := w.Seek(index.segment-8, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := w.Write(head)
+	return err
+}
+
+// How many bytes after the Segment header a recording reserves for a SeekHead.
+const cueReserved = 64
+
+// Where the keyframes are in a recording, as it's being written.
+type cueIndex struct {
+	offset  int64 // Bytes written so far.
+	segment int64 // Where the contents of the last Segment start. Cluster positions are relative to this.
+	points  []cuePoint
+}
+
+type cuePoint struct {
+	time    uint64
+	track   uint64
+	cluster int64
+}
+
+// Take note of a chunk that is about to be written, and return what should be written
+// instead. That's the same thing, except the Segment header, which gets a fixed-width
+// (but still unknown) length and some space for a SeekHead, as `FinalizeCues` needs both.
+func (ci *cueIndex) process(chunk []byte) []byte {
+	switch tag := ebmlParseTagIncomplete(chunk); tag.ID {
+	case ebmlTagSegment:
+		rewritten := make([]byte, 0, len(chunk)+7+cueReserved)
+		rewritten = append(rewritten, chunk[:tag.Consumed-1]...)
+		rewritten = append(rewritten, 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, ebmlTagVoid, 0x80|(cueReserved-2))
+		rewritten = append(rewritten, make([]byte, cueReserved-2)...)
+		ci.segment = ci.offset + int64(tag.Consumed-1) + 8
+		ci.points = nil
+		chunk = append(rewritten, chunk[tag.Consumed:]...)
+
+	case ebmlTagCluster:
+		// A new cluster is always sent along with its first block.
+		rest := chunk[tag.Consumed:]
+		timecode := ebmlParseTag(rest)
+		if timecode.ID != ebmlTagTimecode {
+			break
+		}
+		if track, relative, key := ebmlBlockInfo(timecode.Skip(rest)); key {
+			time := fixedUint(timecode.Contents(rest)) + relative
+			ci.points = append(ci.points, cuePoint{time, track, ci.offset - ci.segment})
+		}
+	}
+	ci.offset += int64(len(chunk))
+	return chunk
+}
+
+// The track, relative timecode, and keyframe flag of a SimpleBlock or a BlockGroup.
+func ebmlBlockInfo(data []byte) (track uint64, timecode uint64, key bool) {
+	tag := ebmlParseTag(data)
+	block := tag.Contents(data)
+	switch tag.ID {
+	case ebmlTagSimpleBlock:
+	case ebmlTagBlockGroup:
+		key, block = true, nil
+		for buf := tag.Contents(data); len(buf) != 0; {
+			tag2 := ebmlParseTag(buf)
+			switch tag2.ID {
+			case 0:
+				return 0, 0, false
+			case ebmlTagBlock:
+				block = tag2.Contents(buf)
+			case ebmlTagReferenceBlock:
+				key = fixedUint(tag2.Contents(buf)) == 0
+			}
+			buf = tag2.Skip(buf)
+		}
+	default:
+		return 0, 0, false
+	}
+	track, consumed := ebmlUint(block)
+	if consumed == 0 || len(block) < consumed+3 {
+		return 0, 0, false
+	}
+	timecode = uint64(block[consumed])<<8 | uint64(block[consumed+1])
+	return track, timecode, key || block[consumed+2]&0x80 != 0
+}
+
+// A copy of the EBML header as sent to viewers, or nil if there's none yet.
+func (cast *Broadcast) HeaderBytes() []byte {
+	cast.vlock.Lock()
+	defer cast.vlock.Unlock()
+	return append([]byte(nil), cast.header...)
+}
+
+// A copy of the beginning of the current Segment (up to and including the tracks)
+// as sent to viewers, or nil if there's none yet.
+func (cast *Broadcast) TracksBytes() []byte {
+	cast.vlock.Lock()
+	defer cast.vlock.Unlock()
+	return append([]byte(nil), cast.tracks...)
+}
+
+// Stop sending blocks to viewers (they are dropped instead) without disconnecting anyone.
+func (cast *Broadcast) Pause() {
+	cast.vlock.Lock()
+	cast.paused = true
+	cast.vlock.Unlock()
+}
+
+// Undo `Pause`. As some blocks have been skipped, viewers will wait for the next keyframe.
+func (cast *Broadcast) Resume() {
+	cast.vlock.Lock()
+	cast.paused = false
+	cast.resumed = true
+	for _, cb := range cast.viewers {
+		cb.seenKeyframes = 0
+	}
+	cast.vlock.Unlock()
+}
+
 func (cast *Broadcast) Reset() {
-	cast.buffer = nil
+	cast.resetUntil(nil)
+}
+
+// Same as `Reset`, but only if `evicted` is not closed yet, i.e. the stream still belongs
+// to the caller. Returns false otherwise.
+func (cast *Broadcast) resetUntil(evicted <-chan struct{}) bool {
+	cast.wlock.Lock()
+	defer cast.wlock.Unlock()
+	select {
+	case <-evicted:
+		return false
+	default:
+		cast.buffer = nil
+		return true
+	}
+}
+
+// How far (in milliseconds) a cluster's timecode may be from the last block's before
+// it's assumed that the encoder has reset its clock or sent garbage. Viewers then get
+// timecodes that simply continue from where they were.
+const maxTimecodeJump = 60000
+
+// Convert an inbound timecode to milliseconds.
+func (cast *Broadcast) rescale(t uint64) uint64 {
+	if cast.timecodeScale == 0 || cast.timecodeScale == 1000000 {
+		return t
+	}
+	// Same as `t * scale / 1000000`, but without overflowing.
+	return t/1000000*cast.timecodeScale + t%1000000*cast.timecodeScale/1000000
+}
+
+func (cast *Broadcast) codecAllowed(id string) bool {
+	for _, allowed := range cast.AllowedCodecs {
+		if id == allowed {
+			return true
+		}
+	}
+	return len(cast.AllowedCodecs) == 0
 }
 
 func (cast *Broadcast) Write(data []byte) (int, error) {
+	cast.wlock.Lock()
+	defer cast.wlock.Unlock()
+	return cast.writeLocked(data)
+}
+
+// Same as `Write`, but `wlock` must already be held.
+func (cast *Broadcast) writeLocked(data []byte) (int, error) {
+	if cast.destroyed {
+		return 0, ErrStreamEnded
+	}
+	n, err := cast.write(data)
+	if cast.dirty {
+		cast.dirty = false
+		info := cast.StreamTrackInfo
+		info.Tracks = append([]TrackInfo(nil), info.Tracks...)
+		cast.lock.Lock()
+		cast.info, cast.infoChanged = info, true
+		cast.lock.Unlock()
+	}
+	if err != nil && cast.onError != nil {
+		cast.onError(err)
+	}
+	return n, err
+}
+
+// Run a WebM stream through the same checks and rewriting as `Broadcast.Write`
+// without sending it anywhere, stopping at the first error. Useful for validating
+// files, and for making sure no input can crash the parser.
+func ParseStream(r io.Reader) error {
+	_, err := newBroadcast(realClock{}).ReadFrom(r)
+	return err
+}
+
+// Returned by `ReadFrom` when the stream is taken over by another writer.
+var ErrEvicted = errors.New("another connection has taken over the stream")
+
+// Returned by `Write` once the stream has been destroyed, e.g. because it has been
+// live for longer than `MaxStreamDuration`.
+var ErrStreamEnded = errors.New("the stream has ended")
+
+// `Write` everything from a reader until EOF (which is not an error), a parse error,
+// or an eviction (see `Evicted`), whichever comes first. In the latter case, nothing
+// read after the eviction is written. If the stream came from `WritableForce`, use
+// `ReadFromUntil` with the channel it returned instead.
+func (cast *Broadcast) ReadFrom(r io.Reader) (int64, error) {
+	return cast.ReadFromUntil(r, cast.Evicted())
+}
+
+// Same as `ReadFrom`, but stop once `evicted` is closed.
+func (cast *Broadcast) ReadFromUntil(r io.Reader, evicted <-chan struct{}) (int64, error) {
+	buffer := [16384]byte{}
+	total := int64(0)
+	for {
+		n, err := r.Read(buffer[:])
+		// Checked under the same lock as `Write`, so nothing gets in after
+		// `WritableForce` has reset the parser for the new writer.
+		cast.wlock.Lock()
+		select {
+		case <-evicted:
+			cast.wlock.Unlock()
+			return total, ErrEvicted
+		default:
+		}
+		if n != 0 {
+			total += int64(n)
+			if _, err := cast.writeLocked(buffer[:n]); err != nil {
+				cast.wlock.Unlock()
+				return total, err
+			}
+		}
+		cast.wlock.Unlock()
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// An `http.Handler` that writes request bodies into the stream: 200 once the body
+// ends, 400 if it's not valid WebM, 409 if another connection has taken over the
+// stream (see `Evicted`), 410 if it has been destroyed (see `ErrStreamEnded`). A
+// single file may be split between any number of requests, so a tag left incomplete
+// at the end of one is continued by the next, unless that one starts a new file with
+// an EBML header.
+func (cast *Broadcast) IngestHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cast.ingest(w, r, cast.Evicted(), http.StatusOK)
+	})
+}
+
+// Same as `IngestHandler`, but for a stream that came from `WritableForce` (see
+// `ReadFromUntil`), and with a custom status for a request that went through.
+func (cast *Broadcast) ingest(w http.ResponseWriter, r *http.Request, evicted <-chan struct{}, status int) {
+	body := bufio.NewReader(r.Body)
+	if id, _ := body.Peek(4); bytes.Equal(id, []byte{0x1A, 0x45, 0xDF, 0xA3}) {
+		// Whatever was left over from the previous file is not going to be finished.
+		cast.resetUntil(evicted)
+	}
+	switch _, err := cast.ReadFromUntil(body, evicted); err {
+	case nil:
+		w.WriteHeader(status)
+	case ErrEvicted:
+		http.Error(w, err.Error(), http.StatusConflict)
+	case ErrStreamEnded:
+		http.Error(w, err.Error(), http.StatusGone)
+	default:
+		// The rest of the broken tag is not coming, so the next request should
+		// start from scratch. (Or the connection has broken, in which case nobody
+		// will see the response anyway.)
+		cast.resetUntil(evicted)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+func (cast *Broadcast) write(data []byte) (int, error) {
+	cast.lock.Lock()
 	cast.rateUnit += float64(len(data))
+	cast.lastWrite = cast.clock.Now()
+	cast.lock.Unlock()
 	cast.buffer = append(cast.buffer, data...)
 
 	for {
@@ -368,8 +1582,12 @@ func (cast *Broadcast) Write(data []byte) (int, error) {
 			if tag.Length == ebmlIndeterminate {
 				return 0, errors.New("exact length required for all tags but Segments and Clusters")
 			}
+			limit := cast.MaxBlockSize
+			if limit == 0 {
+				limit = 1024 * 1024
+			}
 			total := tag.Length + uint64(tag.Consumed)
-			if total > 1024*1024 {
+			if tag.Length > limit || total > limit {
 				return 0, errors.New("data block too big")
 			}
 
@@ -390,30 +1608,71 @@ func (cast *Broadcast) Write(data []byte) (int, error) {
 		case ebmlTagVoid:
 			// Waste of space.
 		case ebmlTagTags:
-			// Maybe later.
+			// Not forwarded to viewers (these can appear anywhere, even after
+			// the clusters), but titles and such are nice to show on the page.
+			metadata := make(map[string]string)
+			for k, v := range cast.Metadata {
+				metadata[k] = v
+			}
+			for buf2 := tag.Contents(buf); len(buf2) != 0; {
+				tag2 := ebmlParseTag(buf2)
+
+				switch tag2.ID {
+				case 0:
+					return 0, errors.New("malformed EBML")
+
+				case ebmlTagTag:
+					if err := ebmlParseSimpleTags(tag2.Contents(buf2), "", 0, metadata); err != nil {
+						return 0, err
+					}
+				}
+
+				buf2 = tag2.Skip(buf2)
+			}
+			cast.Metadata = metadata
+			cast.dirty = true
 		case ebmlTagCluster:
 			// Ignore boundaries, we'll regroup the data anyway.
 		case ebmlTagPrevSize:
 			// Disallow backward seeking too.
 
 		case ebmlTagEBML:
-			// The header is the same in all WebM-s.
-			if len(cast.header) == 0 {
-				cast.header = append([]byte{}, buf...)
+			// The header is normally the same in all WebM-s, but e.g. DocTypeVersion
+			// may differ between encoders.
+			// (`header` is only ever replaced here, so reading it without `vlock` is fine;
+			// `intern` can't be called while holding it, as that needs the set's mutex.)
+			if !bytes.Equal(cast.header, buf) {
+				var header []byte
+				if cast.intern != nil {
+					header = cast.intern(cast.header, buf)
+				} else {
+					header = append([]byte{}, buf...)
+				}
+				cast.vlock.Lock()
+				cast.headerChanged = len(cast.header) != 0
+				cast.header = header
+				cast.vlock.Unlock()
 			}
 
 		case ebmlTagSegment:
 			cast.StreamTrackInfo = StreamTrackInfo{}
+			cast.MuxingApp, cast.WritingApp, cast.DateUTC = "", "", time.Time{}
+			cast.audioTracks = 0
+			cast.videoTracks = 0
+			cast.declaredTracks = 0
 			// Always reset length to indeterminate.
+			cast.vlock.Lock()
 			cast.tracks = append([]byte{}, buf[0], buf[1], buf[2], buf[3], 0xFF)
+			cast.vlock.Unlock()
 			// Will recalculate this when the first block arrives.
 			cast.timecodeShift = 0
+			cast.timecodeScale = 0
 			cast.firstBlockInSegment = true
 
 		case ebmlTagInfo:
 			// Default timecode resolution in Matroska is 1 ms. This value is required
-			// in WebM; we'll check just in case. Obviously, our timecode rewriting
-			// logic won't work with non-millisecond resolutions.
+			// in WebM; we'll check just in case. Our timecode rewriting logic only works
+			// with milliseconds, so other resolutions are converted.
 			scale := uint64(0)
 
 			for buf2 := tag.Contents(buf); len(buf2) != 0; {
@@ -434,18 +1693,47 @@ func (cast *Broadcast) Write(data []byte) (int, error) {
 
 				case ebmlTagTimecodeScale:
 					scale = fixedUint(tag2.Contents(buf2))
+
+				case ebmlTagMuxingApp:
+					cast.MuxingApp = string(tag2.Contents(buf2))
+
+				case ebmlTagWritingApp:
+					cast.WritingApp = string(tag2.Contents(buf2))
+
+				case ebmlTagDateUTC:
+					// Nanoseconds since the start of the millennium, signed.
+					cast.DateUTC = time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(fixedUint(tag2.Contents(buf2))))
 				}
 
 				buf2 = tag2.Skip(buf2)
 			}
 
-			if scale != 1000000 {
+			if scale == 0 {
 				return 0, errors.New("invalid timecode scale")
 			}
 
-			cast.tracks = append(cast.tracks, buf...)
+			cast.timecodeScale = scale
+			info := buf
+			if scale != 1000000 {
+				info = []byte{0x2A, 0xD7, 0xB1, 0x83, 0x0F, 0x42, 0x40} // TimecodeScale = 1000000
+				for buf2 := tag.Contents(buf); len(buf2) != 0; {
+					tag2 := ebmlParseTag(buf2)
+					if tag2.ID != ebmlTagTimecodeScale {
+						info = append(info, buf2[:len(buf2)-len(tag2.Skip(buf2))]...)
+					}
+					buf2 = tag2.Skip(buf2)
+				}
+				info = ebmlTagBytes(ebmlTagInfo, info)
+			}
+			cast.vlock.Lock()
+			cast.tracks = append(cast.tracks, info...)
+			cast.vlock.Unlock()
 
 		case ebmlTagTrackEntry:
+			info := TrackInfo{}
+			frameDuration := uint64(0)
+			languageIETF := ""
+
 			for buf2 := tag.Contents(buf); len(buf2) != 0; {
 				tag2 := ebmlParseTag(buf2)
 
@@ -454,16 +1742,38 @@ func (cast *Broadcast) Write(data []byte) (int, error) {
 					return 0, errors.New("malformed EBML")
 
 				case ebmlTagTrackNumber:
-					// `viewer.seenKeyframes` is a 32-bit vector.
-					if fixedUint(tag2.Contents(buf2)) >= 32 {
+					// `viewer.seenKeyframes` is a 64-bit vector.
+					if info.Number = uint(fixedUint(tag2.Contents(buf2))); info.Number >= 64 {
 						return 0, errors.New("too many tracks")
 					}
 
+				case ebmlTagTrackType:
+					info.Type = uint(fixedUint(tag2.Contents(buf2)))
+
+				case ebmlTagCodecID:
+					info.CodecID = string(tag2.Contents(buf2))
+
+				case ebmlTagName:
+					info.Name = string(tag2.Contents(buf2))
+
+				case ebmlTagLanguage:
+					if languageIETF == "" {
+						info.Language = string(tag2.Contents(buf2))
+					}
+
+				case ebmlTagLanguageIETF:
+					languageIETF = string(tag2.Contents(buf2))
+					info.Language = languageIETF
+
+				case ebmlTagDefaultDuration:
+					// In nanoseconds, regardless of `TimecodeScale`.
+					frameDuration = fixedUint(tag2.Contents(buf2))
+
 				case ebmlTagAudio:
-					cast.HasAudio = true
+					info.Type = 2
 
 				case ebmlTagVideo:
-					cast.HasVideo = true
+					info.Type = 1
 					for buf3 := tag2.Contents(buf2); len(buf3) != 0; {
 						tag3 := ebmlParseTag(buf3)
 
@@ -472,10 +1782,10 @@ func (cast *Broadcast) Write(data []byte) (int, error) {
 							return 0, errors.New("malformed EBML")
 
 						case ebmlTagPixelWidth:
-							cast.Width = uint(fixedUint(tag3.Contents(buf3)))
+							info.Width = uint(fixedUint(tag3.Contents(buf3)))
 
 						case ebmlTagPixelHeight:
-							cast.Height = uint(fixedUint(tag3.Contents(buf3)))
+							info.Height = uint(fixedUint(tag3.Contents(buf3)))
 						}
 
 						buf3 = tag3.Skip(buf3)
@@ -485,20 +1795,63 @@ func (cast *Broadcast) Write(data []byte) (int, error) {
 				buf2 = tag2.Skip(buf2)
 			}
 
+			if !cast.codecAllowed(info.CodecID) {
+				return 0, errors.New("codec not allowed: " + info.CodecID)
+			}
+
+			// `Video` and `Audio` are optional (all of their contents have default values),
+			// so if they are absent, `TrackType` is the only way to know what's inside.
+			switch info.Type {
+			case 1:
+				cast.HasVideo = true
+				cast.Width = info.Width
+				cast.Height = info.Height
+				cast.FrameRate = 0
+				if frameDuration != 0 {
+					cast.FrameRate = 1e9 / float64(frameDuration)
+				}
+				cast.videoTracks |= 1 << info.Number
+			case 2:
+				cast.HasAudio = true
+				cast.audioTracks |= 1 << info.Number
+			}
+			cast.declaredTracks |= 1 << info.Number
+			cast.Tracks = append(cast.Tracks, info)
+			cast.vlock.Lock()
 			cast.tracks = append(cast.tracks, buf...)
+			cast.vlock.Unlock()
 			cast.dirty = true
 
 		case ebmlTagTracks:
+			cast.vlock.Lock()
 			cast.tracks = append(cast.tracks, buf...)
+			cast.vlock.Unlock()
 
 		case ebmlTagTimecode:
-			cast.recvClusterTimecode = fixedUint(tag.Contents(buf)) + cast.timecodeShift
+			cast.clusterTimecode = fixedUint(tag.Contents(buf))
+			cast.recvClusterTimecode = cast.rescale(cast.clusterTimecode) + cast.timecodeShift
+			if recv, sent := cast.recvClusterTimecode, cast.sentTimecode; recv < sent && sent-recv > maxTimecodeJump || recv > sent && recv-sent > maxTimecodeJump {
+				// (This wraps around if the jump is forward, which is fine because
+				// it's only ever added to, also wrapping around.)
+				cast.timecodeShift += sent - recv
+				cast.recvClusterTimecode = sent
+			}
 
 		case ebmlTagBlockGroup, ebmlTagSimpleBlock:
+			// Without these, viewers would get a stream that cannot be decoded at all.
+			if len(cast.header) == 0 {
+				return 0, errors.New("EBML header required before the first block")
+			}
+			if cast.declaredTracks == 0 {
+				return 0, errors.New("Tracks required before the first block")
+			}
 			key := false
 			block := tag.Contents(buf)
+			var reference []byte
 
 			if tag.ID == ebmlTagBlockGroup {
+				// The whole group is forwarded, so `DiscardPadding` (gapless Opus) and such
+				// reach the viewers as is. It's in nanoseconds, so rescaling does not touch it.
 				key, block = true, nil
 
 				for buf2 := tag.Contents(buf); len(buf2) != 0; {
@@ -511,9 +1864,16 @@ func (cast *Broadcast) Write(data []byte) (int, error) {
 					case ebmlTagBlock:
 						block = tag2.Contents(buf2)
 
+					case ebmlTagBlockDuration:
+						duration := tag2.Contents(buf2)
+						if !putFixedUint(duration, cast.rescale(fixedUint(duration))) {
+							return 0, errors.New("block duration out of range")
+						}
+
 					case ebmlTagReferenceBlock:
 						// Keyframes, by definition, have no reference frame.
-						key = fixedUint(tag2.Contents(buf2)) == 0
+						reference = tag2.Contents(buf2)
+						key = fixedUint(reference) == 0
 					}
 
 					buf2 = tag2.Skip(buf2)
@@ -525,13 +1885,52 @@ func (cast *Broadcast) Write(data []byte) (int, error) {
 			}
 
 			track, consumed := ebmlUint(block)
-			if consumed == 0 || track >= 32 || len(block) < consumed+3 {
+			if consumed == 0 || track >= 64 || len(block) < consumed+3 {
 				return 0, errors.New("invalid track")
 			}
+			if cast.declaredTracks&(1<<track) == 0 {
+				// Viewers would wait forever for a keyframe of it.
+				return 0, errors.New("block for an undeclared track")
+			}
 			// This bit is always 0 in a Block, but 1 in a keyframe SimpleBlock.
 			key = key || block[consumed+2]&0x80 != 0
-			// Block timecodes are relative to cluster ones.
-			timecode := uint64(block[consumed+0])<<8 | uint64(block[consumed+1])
+			// Audio frames do not reference each other, so any of them is a valid starting
+			// point, even if the muxer did not bother to mark it as such. Without this,
+			// viewers of audio-only streams could wait forever for a "keyframe".
+			key = key || cast.audioTracks&(1<<track) != 0
+			// Laced blocks contain several frames. The keyframe flag applies to all of them,
+			// so this only matters to `OnKeyframe`, but garbage should not reach viewers.
+			laces, err := ebmlSplitLaces(block[consumed+2]>>1&3, block[consumed+3:])
+			if err != nil {
+				return 0, err
+			}
+			// Block timecodes are signed and relative to cluster ones. (The arithmetic
+			// wraps around for negative ones, which is fine since it's all relative.)
+			rel := uint64(int16(uint16(block[consumed+0])<<8 | uint16(block[consumed+1])))
+			if int64(rel) < 0 && -rel > cast.clusterTimecode {
+				rel = -cast.clusterTimecode
+			}
+			timecode := cast.rescale(cast.clusterTimecode+rel) - cast.rescale(cast.clusterTimecode)
+			if ref := fixedInt(reference); len(reference) <= 8 && ref != 0 {
+				at, target := cast.clusterTimecode+rel, cast.clusterTimecode+rel+uint64(ref)
+				if ref < 0 && uint64(-ref) > at {
+					target = 0
+				}
+				scaled := int64(cast.rescale(target) - cast.rescale(at))
+				if scaled == 0 && ref < 0 {
+					scaled = -1 // 0 would make it a keyframe.
+				} else if scaled == 0 {
+					scaled = 1
+				}
+				putFixedInt(reference, scaled)
+			}
+			// With a coarser `TimecodeScale`, this may not fit into 16 bits anymore, in which
+			// case the block goes into a cluster of its own.
+			inCluster := timecode
+			if int64(timecode) < math.MinInt16 || int64(timecode) > math.MaxInt16 {
+				inCluster = 0
+			}
+			block[consumed+0], block[consumed+1] = byte(inCluster>>8), byte(inCluster)
 			if cast.recvClusterTimecode+timecode < cast.sentTimecode {
 				// Allow non-monotonic blocks within a single segment (this simply means that
 				// coding order is not the same as display order)
@@ -544,7 +1943,47 @@ func (cast *Broadcast) Write(data []byte) (int, error) {
 				cast.sentTimecode = cast.recvClusterTimecode + timecode
 			}
 
-			ctc := cast.recvClusterTimecode
+			cast.lock.Lock()
+			cast.lastBlock = cast.clock.Now()
+			cast.lock.Unlock()
+
+			if cast.firstBlockInSegment {
+				// By now, all of the segment's tracks have been declared.
+				shape := StreamTrackInfo{HasVideo: cast.HasVideo, HasAudio: cast.HasAudio, Width: cast.Width, Height: cast.Height}
+				changed := cast.haveShape && (shape.HasVideo != cast.lastShape.HasVideo ||
+					shape.HasAudio != cast.lastShape.HasAudio ||
+					shape.Width != cast.lastShape.Width || shape.Height != cast.lastShape.Height)
+				cast.lastShape, cast.haveShape = shape, true
+				if changed && cast.OnMetadataChange != nil {
+					cast.OnMetadataChange()
+				}
+			}
+
+			if key && cast.OnKeyframe != nil && cast.videoTracks&(1<<track) != 0 {
+				for _, lace := range laces {
+					cast.OnKeyframe(uint(track), cast.recvClusterTimecode+timecode, lace)
+				}
+			}
+
+			cast.vlock.Lock()
+			paused, resumed := cast.paused, cast.resumed && !cast.paused
+			if resumed {
+				cast.resumed = false
+			}
+			cast.vlock.Unlock()
+			if resumed {
+				// The blocks skipped while paused are missing from the ring, so new
+				// viewers would get deltas that depend on them.
+				cast.frames.Reset()
+			}
+			if paused {
+				// Otherwise every out-of-order block would be taken for the first one
+				// and shift the timecodes again.
+				cast.firstBlockInSegment = false
+				break
+			}
+
+			ctc := cast.recvClusterTimecode + timecode - inCluster
 			cluster := []byte{
 				// indeterminate length cluster
 				ebmlTagCluster >> 24 & 0xFF, ebmlTagCluster >> 16 & 0xFF, ebmlTagCluster >> 8 & 0xFF, ebmlTagCluster & 0xFF, 0xFF,
@@ -557,23 +1996,60 @@ func (cast *Broadcast) Write(data []byte) (int, error) {
 
 			forceCluster := ctc != cast.sentClusterTimecode
 			cast.vlock.Lock()
+			if cast.headerChanged || !sameTracks(cast.Tracks, cast.sentTracks) {
+				// Codecs have changed, so blocks of the previous segment are no good
+				// and everyone needs the new track info. (Not necessarily at the first
+				// block of the segment, as there may have been a `Pause` since.)
+				cast.sentTracks = cast.Tracks
+				cast.headerChanged = false
+				cast.frames.Reset()
+				for _, cb := range cast.viewers {
+					cb.skipHeaders = false
+					cb.skipCluster = false
+					cb.seenKeyframes = 0
+				}
+			}
 			for _, cb := range cast.viewers {
 				if !cb.skipHeaders {
 					if !cb.write(cast.header) || !cb.write(cast.tracks) {
 						continue // FIXME: if second write failed, the stream will not be a valid mkv
 					}
 					cb.skipHeaders = true
-					cast.frames.Read(cb.WriteFrame)
+					cb.seenKeyframes &^= cast.frames.Read(cb.WriteFrame)
 				}
 				cb.WriteFrame(cluster, forceCluster, packed)
 			}
+			if cast.SlowViewerStrategy == SlowViewerDisconnect {
+				for ch, cb := range cast.viewers {
+					if cb.stalls > cast.SlowViewerThreshold {
+						delete(cast.viewers, ch)
+						close(ch)
+					}
+				}
+			}
+			var taps []BlockTap
+			for _, tap := range cast.taps {
+				taps = append(taps, tap)
+			}
 			cast.vlock.Unlock()
+			for _, tap := range taps {
+				tap(uint(track), key, ctc+inCluster, buf)
+			}
 			if forceCluster {
 				cast.frames.PushCluster(cluster)
 			}
 			cast.frames.PushFrame(packed)
+			if key && cast.CacheKeyframes {
+				cast.frames.PushKeyframe(cluster, packed)
+			}
 			cast.sentClusterTimecode = ctc
 			cast.firstBlockInSegment = false
+			if !cast.started {
+				cast.started = true
+				if cast.onStart != nil {
+					cast.onStart()
+				}
+			}
 
 		default:
 			return 0, errors.New("unknown EBML tag")
@@ -0,0 +1,1611 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andradeandrey/webmcast/webmtest"
+)
+
+// A complete stream with one VP8 track and a keyframe followed by a delta frame.
+func testStream() []byte {
+	return webmtest.Cat(
+		webmtest.Header(),
+		webmtest.Segment(),
+		webmtest.Info(1000000),
+		webmtest.Tracks(webmtest.Video(1, "V_VP8", 320, 240)),
+		webmtest.Cluster(0),
+		webmtest.SimpleBlock(1, 0, true, []byte{1, 2, 3}),
+		webmtest.SimpleBlock(1, 40, false, []byte{4, 5}),
+	)
+}
+
+// A clock that only moves when told to. All tickers share the same channel.
+type fakeClock struct {
+	mutex sync.Mutex // (Streams read the time from their own goroutines.)
+	now   time.Time
+	c     chan time.Time
+}
+
+type fakeTicker struct{ c chan time.Time }
+
+func (f *fakeClock) NewTicker(d time.Duration) Ticker { return fakeTicker{f.c} }
+func (t fakeTicker) C() <-chan time.Time              { return t.c }
+func (t fakeTicker) Stop()                            {}
+
+func (f *fakeClock) Now() time.Time {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.now
+}
+
+// Move the clock forward by `d` and return the new time.
+func (f *fakeClock) advance(d time.Duration) time.Time {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.now = f.now.Add(d)
+	return f.now
+}
+
+// Advance the clock by `d` and deliver a tick. Blocks until some ticker receives it.
+func (f *fakeClock) tick(d time.Duration) {
+	f.c <- f.advance(d)
+}
+
+// Write the concatenation of some tags, failing the test if that's an error.
+func testWrite(t *testing.T, cast *Broadcast, tags ...[]byte) {
+	t.Helper()
+	if _, err := cast.Write(webmtest.Cat(tags...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Everything sent to a viewer so far.
+func received(ch chan []byte) [][]byte {
+	var r [][]byte
+	for {
+		select {
+		case chunk := <-ch:
+			r = append(r, chunk)
+		default:
+			return r
+		}
+	}
+}
+
+func FuzzBroadcastWrite(f *testing.F) {
+	f.Add(testStream())
+	f.Add(webmtest.Cat(
+		webmtest.Header(),
+		webmtest.Segment(),
+		webmtest.Info(1000000),
+		webmtest.Tracks(webmtest.Video(1, "V_VP9", 640, 480), webmtest.Audio(2, "A_OPUS")),
+		webmtest.Cluster(0),
+		webmtest.SimpleBlock(1, 0, true, []byte{1, 2, 3}),
+		webmtest.BlockGroup(2, 5, 0, []byte{4, 5}),
+		webmtest.BlockGroup(1, 40, -40, []byte{6}),
+	))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// Errors are fine, panics are not.
+		ParseStream(bytes.NewReader(data))
+		// The same, but with tags split between writes like they would be by the network.
+		cast := newBroadcast(realClock{})
+		for len(data) > 0 {
+			n := 1 + int(data[0])%32
+			if n > len(data) {
+				n = len(data)
+			}
+			if _, err := cast.Write(data[:n]); err != nil {
+				break
+			}
+			data = data[n:]
+		}
+	})
+}
+
+func TestOnStreamStart(t *testing.T) {
+	started := 0
+	set := BroadcastSet{OnStreamStart: func(id string) { started++ }, OnStreamTrackInfo: func(string, *StreamTrackInfo) {}}
+	defer set.Shutdown(context.Background())
+	cast, _ := set.Writable("test")
+	data := testStream()
+	if _, err := cast.Write(data[:len(data)-20]); err != nil {
+		t.Fatal(err)
+	}
+	if started != 0 {
+		t.Fatal("called before the first block")
+	}
+	if _, err := cast.Write(data[len(data)-20:]); err != nil {
+		t.Fatal(err)
+	}
+	if started != 1 {
+		t.Fatal("not called when the first block arrived")
+	}
+	if _, err := cast.Write(webmtest.SimpleBlock(1, 80, true, []byte{6})); err != nil {
+		t.Fatal(err)
+	}
+	if started != 1 {
+		t.Fatal("called more than once")
+	}
+}
+
+func TestRecordingReparse(t *testing.T) {
+	cast := newBroadcast(realClock{})
+	var file bytes.Buffer
+	if err := cast.StartRecording(&file); err != nil {
+		t.Fatal(err)
+	}
+	if err := cast.StartRecording(&file); err == nil {
+		t.Fatal("started recording twice")
+	}
+	if _, err := cast.Write(testStream()); err != nil {
+		t.Fatal(err)
+	}
+	if err := cast.StopRecording(); err != nil {
+		t.Fatal(err)
+	}
+	if file.Len() == 0 {
+		t.Fatal("nothing recorded")
+	}
+	again := newBroadcast(realClock{})
+	if _, err := again.ReadFrom(&file); err != nil {
+		t.Fatal("the recording is not valid: ", err)
+	}
+	if !again.started {
+		t.Fatal("no blocks recorded")
+	}
+	if again.Width != 320 || again.Height != 240 || len(again.Tracks) != 1 || again.Tracks[0].CodecID != "V_VP8" {
+		t.Fatal(again.StreamTrackInfo)
+	}
+}
+
+func TestWritableForceHandoff(t *testing.T) {
+	set := BroadcastSet{OnStreamTrackInfo: func(string, *StreamTrackInfo) {}}
+	defer set.Shutdown(context.Background())
+	old, oldEvicted, _ := set.WritableForce("test")
+	ch := make(chan []byte, 1000)
+	old.Connect(ch, false, ^uint64(0))
+
+	// The old writer is stuck in the middle of a tag when the new one arrives.
+	r, w := io.Pipe()
+	defer w.Close()
+	done := make(chan error)
+	go func() {
+		_, err := old.ReadFromUntil(r, oldEvicted)
+		done <- err
+	}()
+	data := testStream()
+	w.Write(data[:len(data)-3])
+
+	cast, evicted, ok := set.WritableForce("test")
+	if !ok || cast != old {
+		t.Fatal("not taken over")
+	}
+	select {
+	case <-oldEvicted:
+	default:
+		t.Fatal("the old writer was not evicted")
+	}
+	// Whatever the old writer still has must not reach the parser.
+	go w.Write([]byte{0xFF, 0xFF, 0xFF})
+	if err := <-done; err != ErrEvicted {
+		t.Fatal(err)
+	}
+	received(ch)
+	if _, err := cast.ReadFromUntil(bytes.NewReader(testStream()), evicted); err != nil {
+		t.Fatal(err)
+	}
+	if got := received(ch); len(got) == 0 {
+		t.Fatal("the new writer's blocks were not forwarded")
+	}
+}
+
+func TestStatsWhileWriting(t *testing.T) {
+	cast := newBroadcast(realClock{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			if _, err := cast.Write(testStream()); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			if stats := cast.Stats(); !stats.HasVideo || stats.HasAudio {
+				t.Fatal(stats)
+			}
+			return
+		default:
+			// Either all zero (nothing parsed yet) or the complete first segment.
+			if stats := cast.Stats(); stats.HasAudio {
+				t.Fatal(stats)
+			}
+		}
+	}
+}
+
+func TestBlockGroupForwarded(t *testing.T) {
+	cast := newBroadcast(realClock{})
+	ch := make(chan []byte, 100)
+	cast.Connect(ch, false, ^uint64(0))
+	padding := webmtest.Tag(0x75A2, []byte{0x00, 0x63, 0x2E, 0xA0}) // DiscardPadding = 6.5ms
+	group := webmtest.Tag(webmtest.TagBlockGroup,
+		webmtest.Tag(webmtest.TagBlock, []byte{0x81, 0, 10, 0}, []byte{1, 2, 3}),
+		webmtest.Tag(0x9B, []byte{0, 40}), // BlockDuration = 40 units of 0.5ms
+		padding,
+	)
+	data := webmtest.Cat(
+		webmtest.Header(),
+		webmtest.Segment(),
+		webmtest.Info(500000),
+		webmtest.Tracks(webmtest.Audio(1, "A_OPUS")),
+		webmtest.Cluster(0),
+		group,
+	)
+	if _, err := cast.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	chunks := received(ch)
+	last := chunks[len(chunks)-1]
+	i := bytes.Index(last, []byte{0xA0})
+	if i < 0 || !bytes.HasSuffix(last, padding) {
+		t.Fatalf("DiscardPadding not forwarded as is: %x", last)
+	}
+	// Both the block's timecode and the duration are converted to milliseconds.
+	if !bytes.Contains(last[i:], []byte{0xA1, 0x87, 0x81, 0, 5, 0, 1, 2, 3}) {
+		t.Fatalf("wrong block: %x", last[i:])
+	}
+	if !bytes.Contains(last[i:], []byte{0x9B, 0x82, 0, 20}) {
+		t.Fatalf("wrong duration: %x", last[i:])
+	}
+}
+
+func TestPause(t *testing.T) {
+	cast := newBroadcast(realClock{})
+	ch := make(chan []byte, 100)
+	cast.Connect(ch, false, ^uint64(0))
+	if _, err := cast.Write(testStream()); err != nil {
+		t.Fatal(err)
+	}
+	received(ch)
+	cast.Pause()
+	// A new segment that starts over, with B-frames.
+	paused := webmtest.Cat(webmtest.Segment(), webmtest.Info(1000000),
+		webmtest.Tracks(webmtest.Video(1, "V_VP8", 320, 240)), webmtest.Cluster(0))
+	for i := 0; i < 10; i++ {
+		paused = append(paused, webmtest.SimpleBlock(1, int16(40*i+20), i == 0, []byte{1})...)
+		paused = append(paused, webmtest.SimpleBlock(1, int16(40*i), false, []byte{2})...)
+	}
+	if _, err := cast.Write(paused); err != nil {
+		t.Fatal(err)
+	}
+	if got := received(ch); len(got) != 0 {
+		t.Fatal("forwarded while paused: ", got)
+	}
+	// The first segment ended at 40ms, so the second one (starting at 20ms) was shifted
+	// by 20ms, once.
+	if cast.timecodeShift != 20 {
+		t.Fatal("shifted by ", cast.timecodeShift)
+	}
+	cast.Resume()
+	if _, err := cast.Write(webmtest.Cat(webmtest.Cluster(1000), webmtest.SimpleBlock(1, 0, true, []byte{3}))); err != nil {
+		t.Fatal(err)
+	}
+	if got := received(ch); len(got) != 1 {
+		t.Fatal("not resumed: ", got)
+	}
+}
+
+func TestResumeNewViewer(t *testing.T) {
+	cast := newBroadcast(realClock{})
+	if _, err := cast.Write(testStream()); err != nil {
+		t.Fatal(err)
+	}
+	cast.Pause()
+	paused := webmtest.Cat(
+		webmtest.Cluster(1000),
+		webmtest.SimpleBlock(1, 0, true, []byte{1}),
+		webmtest.SimpleBlock(1, 40, false, []byte{2}),
+	)
+	if _, err := cast.Write(paused); err != nil {
+		t.Fatal(err)
+	}
+	cast.Resume()
+	// Depends on the blocks that were skipped.
+	if _, err := cast.Write(webmtest.SimpleBlock(1, 80, false, []byte{9})); err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan []byte, 100)
+	cast.Connect(ch, false, ^uint64(0))
+	if _, err := cast.Write(webmtest.SimpleBlock(1, 120, true, []byte{7})); err != nil {
+		t.Fatal(err)
+	}
+	// The EBML header, the segment header with the tracks, and then the new keyframe.
+	chunks := received(ch)
+	if len(chunks) != 3 {
+		t.Fatalf("blocks from before the pause were sent: %x", chunks)
+	}
+	if first := chunks[2]; !bytes.HasSuffix(first, []byte{0x80, 7}) {
+		t.Fatalf("the first block is not the keyframe: %x", first)
+	}
+}
+
+func TestIngestHandler(t *testing.T) {
+	cast := newBroadcast(realClock{})
+	ch := make(chan []byte, 100)
+	cast.Connect(ch, false, ^uint64(0))
+	srv := httptest.NewServer(cast.IngestHandler())
+	defer srv.Close()
+	put := func(body []byte) int {
+		req, err := http.NewRequest("PUT", srv.URL, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// The last block is split between two requests.
+	data := testStream()
+	if code := put(data[:len(data)-3]); code != http.StatusOK {
+		t.Fatal(code)
+	}
+	if code := put(data[len(data)-3:]); code != http.StatusOK || cast.Width != 320 {
+		t.Fatal(code, cast.StreamTrackInfo)
+	}
+	chunks := received(ch)
+	if len(chunks) == 0 || !bytes.Equal(chunks[len(chunks)-1], webmtest.SimpleBlock(1, 40, false, []byte{4, 5})) {
+		t.Fatalf("not reassembled: %x", chunks)
+	}
+	// A new file replaces whatever was left unfinished by the previous one.
+	if code := put(data[:len(data)-1]); code != http.StatusOK {
+		t.Fatal(code)
+	}
+	if code := put(data); code != http.StatusOK {
+		t.Fatal("not reset by a new header: ", code)
+	}
+	if code := put(webmtest.SimpleBlock(7, 0, true, []byte{1})); code != http.StatusBadRequest {
+		t.Fatal("accepted a block of a track that does not exist: ", code)
+	}
+	if code := put(webmtest.SimpleBlock(1, 80, true, []byte{1})); code != http.StatusOK {
+		t.Fatal("not reset after an error: ", code)
+	}
+}
+
+func TestIngestEvicted(t *testing.T) {
+	set := BroadcastSet{OnStreamTrackInfo: func(string, *StreamTrackInfo) {}}
+	defer set.Shutdown(context.Background())
+	cast, evicted, _ := set.WritableForce("test")
+	set.WritableForce("test")
+	w := httptest.NewRecorder()
+	cast.ingest(w, httptest.NewRequest("PUT", "/", bytes.NewReader(testStream())), evicted, http.StatusNoContent)
+	if w.Code != http.StatusConflict {
+		t.Fatal("wrote after being evicted: ", w.Code)
+	}
+	if len(cast.buffer) != 0 || cast.Width != 0 {
+		t.Fatal("the new writer's state was changed")
+	}
+}
+
+// Streams switching back and forth between two common headers (e.g. the broadcaster
+// has restarted with a different encoder). When interned, no new copies are made.
+func BenchmarkHeaders(b *testing.B) {
+	headers := [][]byte{
+		webmtest.Header(),
+		webmtest.Tag(webmtest.TagEBML, webmtest.Uint(webmtest.TagEBMLVersion, 1), webmtest.String(webmtest.TagDocType, "webm")),
+	}
+	for _, interned := range []bool{false, true} {
+		name := "Copied"
+		if interned {
+			name = "Interned"
+		}
+		b.Run(name, func(b *testing.B) {
+			set := BroadcastSet{}
+			casts := make([]*Broadcast, 100)
+			for i := range casts {
+				casts[i] = newBroadcast(realClock{})
+				if interned {
+					casts[i].intern = set.internHeader
+				}
+				casts[i].Write(headers[i%2])
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				cast := casts[i%len(casts)]
+				cast.Write(headers[(i/len(casts)+i+1)%2])
+			}
+		})
+	}
+}
+
+func TestMaxStreamDuration(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0), c: make(chan time.Time)}
+	reasons := make(chan CloseReason, 1)
+	set := BroadcastSet{
+		Clock:               clock,
+		Timeout:             time.Hour,
+		TickInterval:        time.Second,
+		MaxStreamDuration:   3 * time.Second,
+		OnStreamTrackInfo:   func(string, *StreamTrackInfo) {},
+		OnStreamCloseReason: func(id string, r CloseReason) { reasons <- r },
+	}
+	defer set.Shutdown(context.Background())
+	cast, _ := set.Writable("test")
+	ch := make(chan []byte, 100)
+	cast.Connect(ch, true, ^uint64(0))
+	for i := 0; i < 3; i++ {
+		clock.tick(time.Second)
+	}
+	// Started later, so it's still within the limit, but has the same header.
+	other, _ := set.Writable("other")
+	for _, s := range []*Broadcast{cast, other} {
+		if _, err := s.Write(testStream()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case r := <-reasons:
+		t.Fatal("closed too early: ", r)
+	default:
+	}
+	now := clock.advance(time.Second)
+	// The streams share the ticker channel, so it's not known which one gets a tick.
+	var reason CloseReason
+wait:
+	for {
+		select {
+		case reason = <-reasons:
+			break wait
+		case clock.c <- now:
+		}
+	}
+	if reason != CloseDurationLimit {
+		t.Fatal(reason)
+	}
+	if got := received(ch); len(got) == 0 || len(got[len(got)-1]) != 0 {
+		t.Fatal("no end-of-stream marker: ", got)
+	}
+	// The broadcaster is still connected, and has restarted the encoder.
+	if _, err := cast.Write(testStream()); err != ErrStreamEnded {
+		t.Fatal(err)
+	}
+	set.mutex.Lock()
+	refs := set.headers[string(webmtest.Header())].refs
+	set.mutex.Unlock()
+	if refs != 1 {
+		t.Fatal("the shared header now has ", refs, " references")
+	}
+}
+
+func TestCacheKeyframes(t *testing.T) {
+	for _, cache := range []bool{true, false} {
+		cast := newBroadcast(realClock{})
+		cast.CacheKeyframes = cache
+		data := webmtest.Cat(
+			webmtest.Header(),
+			webmtest.Segment(),
+			webmtest.Info(1000000),
+			webmtest.Tracks(webmtest.Video(1, "V_VP9", 640, 480)),
+			webmtest.Cluster(0),
+			webmtest.SimpleBlock(1, 0, true, []byte{0xAA}),
+		)
+		// More than fits in the buffer, so the keyframe falls out of it.
+		for i := 1; i < 200; i++ {
+			data = append(data, webmtest.Cat(webmtest.Cluster(uint64(i*10)), webmtest.SimpleBlock(1, 0, false, []byte{0xBB}))...)
+		}
+		if _, err := cast.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		ch := make(chan []byte, 1000)
+		cast.Connect(ch, false, ^uint64(0))
+		// The deltas only make sense after the ones that were dropped, so the viewer
+		// should get the cached keyframe and then wait for a new one.
+		if _, err := cast.Write(webmtest.Cat(webmtest.Cluster(2000), webmtest.SimpleBlock(1, 0, false, []byte{0xCC}))); err != nil {
+			t.Fatal(err)
+		}
+		chunks := received(ch)
+		if cache && (len(chunks) != 3 || !bytes.HasSuffix(chunks[2], webmtest.SimpleBlock(1, 0, true, []byte{0xAA}))) {
+			t.Fatalf("cached: %x", chunks)
+		}
+		if !cache && len(chunks) != 2 {
+			t.Fatalf("not cached: %x", chunks)
+		}
+		if _, err := cast.Write(webmtest.Cat(webmtest.Cluster(2010), webmtest.SimpleBlock(1, 0, true, []byte{0xDD}))); err != nil {
+			t.Fatal(err)
+		}
+		if chunks := received(ch); len(chunks) != 1 || !bytes.HasSuffix(chunks[0], []byte{0xDD}) {
+			t.Fatalf("cache = %v: %x", cache, chunks)
+		}
+	}
+}
+
+func TestTimecodeScale(t *testing.T) {
+	for _, c := range []struct {
+		scale   uint64
+		cluster uint64
+		blocks  [][]byte
+		expect  [][]byte // What viewers get after the cluster's timecode (in ms).
+		at      []uint64
+	}{
+		{
+			scale:   100000,
+			cluster: 12345,
+			blocks: [][]byte{
+				webmtest.SimpleBlock(1, 25, true, []byte{1}),
+				// 1237.1 ms, referencing 1237.0 ms, which would round to the same time.
+				webmtest.BlockGroup(1, 26, -1, []byte{2}),
+			},
+			expect: [][]byte{
+				webmtest.SimpleBlock(1, 3, true, []byte{1}),
+				webmtest.BlockGroup(1, 3, -1, []byte{2}),
+			},
+			at: []uint64{1234, 1234},
+		},
+		{
+			scale:   10000000,
+			cluster: 100,
+			blocks: [][]byte{
+				webmtest.SimpleBlock(1, 0, true, []byte{1}),
+				webmtest.SimpleBlock(1, 100, false, []byte{2}),
+				// 50 seconds later, which is more than a block timecode can hold.
+				webmtest.BlockGroup(1, 5000, -10, []byte{3}),
+				webmtest.SimpleBlock(1, -5, false, []byte{4}),
+			},
+			expect: [][]byte{
+				webmtest.SimpleBlock(1, 0, true, []byte{1}),
+				webmtest.SimpleBlock(1, 1000, false, []byte{2}),
+				webmtest.BlockGroup(1, 0, -100, []byte{3}),
+				webmtest.SimpleBlock(1, -50, false, []byte{4}),
+			},
+			at: []uint64{1000, 1000, 51000, 1000},
+		},
+	} {
+		cast := newBroadcast(realClock{})
+		ch := make(chan []byte, 100)
+		cast.Connect(ch, false, ^uint64(0))
+		data := webmtest.Cat(
+			webmtest.Header(),
+			webmtest.Segment(),
+			webmtest.Info(c.scale),
+			webmtest.Tracks(webmtest.Video(1, "V_VP8", 320, 240)),
+			webmtest.Cluster(c.cluster),
+		)
+		for _, b := range c.blocks {
+			data = append(data, b...)
+		}
+		if _, err := cast.Write(data); err != nil {
+			t.Fatalf("scale %d: %v", c.scale, err)
+		}
+		chunks := received(ch)
+		if len(chunks) != 2+len(c.expect) {
+			t.Fatalf("scale %d: %d chunks", c.scale, len(chunks))
+		}
+		tcs := uint64(0)
+		for i, chunk := range chunks[2:] {
+			// Each block is either in a new cluster with an 8-byte timecode or in the same one.
+			if bytes.HasPrefix(chunk, []byte{0x1F, 0x43, 0xB6, 0x75}) {
+				tcs, chunk = fixedUint(chunk[7:15]), chunk[15:]
+			}
+			if tcs != c.at[i] || !bytes.Equal(chunk, c.expect[i]) {
+				t.Fatalf("scale %d: block %d: at %d: %x", c.scale, i, tcs, chunk)
+			}
+		}
+		// The output is in milliseconds, and says so.
+		again := newBroadcast(realClock{})
+		if _, err := again.Write(webmtest.Cat(chunks...)); err != nil || again.timecodeScale != 1000000 {
+			t.Fatalf("scale %d: output has scale %d: %v", c.scale, again.timecodeScale, err)
+		}
+	}
+}
+
+func TestTimecodeResets(t *testing.T) {
+	cast := newBroadcast(realClock{})
+	ch := make(chan []byte, 1000)
+	cast.Connect(ch, false, ^uint64(0))
+	testWrite(t, cast, webmtest.Header(), webmtest.Segment(), webmtest.Info(1000000),
+		webmtest.Tracks(webmtest.Audio(1, "A_OPUS")))
+	for i := 0; i < 50; i++ {
+		// The encoder keeps resetting its clock every 5 clusters, and once sends garbage.
+		timecode := uint64(i%5) * 30000
+		if i == 30 {
+			timecode = 1 << 62
+		}
+		testWrite(t, cast, webmtest.Cluster(timecode),
+			webmtest.SimpleBlock(1, 0, true, []byte{1}),
+			webmtest.SimpleBlock(1, 20, true, []byte{2}))
+	}
+	last, clusters := uint64(0), 0
+	for _, chunk := range received(ch) {
+		if !bytes.HasPrefix(chunk, []byte{0x1F, 0x43, 0xB6, 0x75}) {
+			continue
+		}
+		// Viewers see a clock that keeps going at the same pace, never jumping.
+		if timecode := fixedUint(chunk[7:15]); timecode < last || timecode-last > 30000 {
+			t.Fatalf("cluster %d: from %d to %d", clusters, last, timecode)
+		} else {
+			last = timecode
+		}
+		clusters++
+	}
+	if clusters != 50 {
+		t.Fatalf("%d clusters", clusters)
+	}
+}
+
+func TestAudioOnly(t *testing.T) {
+	cast := newBroadcast(realClock{})
+	testWrite(t, cast,
+		webmtest.Header(),
+		webmtest.Segment(),
+		webmtest.Info(1000000),
+		webmtest.Tracks(webmtest.Audio(1, "A_OPUS")),
+		webmtest.Cluster(0),
+		webmtest.SimpleBlock(1, 0, true, []byte{1}),
+		webmtest.SimpleBlock(1, 20, true, []byte{2}),
+	)
+	if cast.HasVideo || !cast.HasAudio || cast.Width != 0 || cast.Height != 0 {
+		t.Fatalf("%+v", cast.StreamTrackInfo)
+	}
+	// Every audio frame is a keyframe, even if the muxer did not say so.
+	ch := make(chan []byte, 100)
+	cast.Connect(ch, false, ^uint64(0))
+	testWrite(t, cast, webmtest.SimpleBlock(1, 40, false, []byte{3}))
+	if chunks := received(ch); len(chunks) != 5 || !bytes.HasSuffix(chunks[4], webmtest.SimpleBlock(1, 40, false, []byte{3})) {
+		t.Fatalf("%x", chunks)
+	}
+}
+
+func TestMaxBlockSize(t *testing.T) {
+	start := webmtest.Cat(
+		webmtest.Header(),
+		webmtest.Segment(),
+		webmtest.Info(1000000),
+		webmtest.Tracks(webmtest.Video(1, "V_VP9", 3840, 2160)),
+		webmtest.Cluster(0),
+	)
+	big := webmtest.SimpleBlock(1, 0, true, make([]byte, 2<<20))
+	cast := newBroadcast(realClock{})
+	if _, err := cast.Write(webmtest.Cat(start, big)); err == nil {
+		t.Fatal("accepted a block larger than 1 MiB by default")
+	}
+	for _, c := range []struct {
+		limit uint64
+		ok    bool
+	}{{uint64(len(big)), true}, {uint64(len(big)) - 1, false}} {
+		cast := newBroadcast(realClock{})
+		cast.MaxBlockSize = c.limit
+		if _, err := cast.Write(webmtest.Cat(start, big)); (err == nil) != c.ok {
+			t.Fatalf("%d bytes with a limit of %d: %v", len(big), c.limit, err)
+		}
+	}
+}
+
+func TestManyTracks(t *testing.T) {
+	var entries [][]byte
+	for i := uint64(1); i <= 40; i++ {
+		entries = append(entries, webmtest.Video(i, "V_VP8", 320, 240))
+	}
+	cast := newBroadcast(realClock{})
+	testWrite(t, cast, webmtest.Header(), webmtest.Segment(), webmtest.Info(1000000), webmtest.Tracks(entries...), webmtest.Cluster(0))
+	ch := make(chan []byte, 100)
+	cast.Connect(ch, false, ^uint64(0))
+	for i := uint64(1); i <= 40; i++ {
+		testWrite(t, cast, webmtest.SimpleBlock(i, 0, false, []byte{byte(i)}))
+	}
+	if chunks := received(ch); len(chunks) != 2 {
+		t.Fatalf("deltas sent before any keyframes: %x", chunks)
+	}
+	// Each track starts at its own keyframe, regardless of what the others do.
+	for _, track := range []uint64{39, 33, 40} {
+		testWrite(t, cast, webmtest.SimpleBlock(track, 0, true, []byte{0xAA}))
+		for i := uint64(1); i <= 40; i++ {
+			testWrite(t, cast, webmtest.SimpleBlock(i, 0, false, []byte{byte(i)}))
+		}
+		chunks := received(ch)
+		if len(chunks) == 0 || !bytes.HasSuffix(chunks[0], webmtest.SimpleBlock(track, 0, true, []byte{0xAA})) {
+			t.Fatalf("track %d: %x", track, chunks)
+		}
+		var got []uint64
+		for _, chunk := range chunks[1:] {
+			got = append(got, uint64(chunk[len(chunk)-1]))
+		}
+		expect := map[uint64][]uint64{39: {39}, 33: {33, 39}, 40: {33, 39, 40}}[track]
+		if !reflect.DeepEqual(got, expect) {
+			t.Fatalf("track %d: deltas for tracks %v", track, got)
+		}
+	}
+}
+
+func TestOnKeyframe(t *testing.T) {
+	type keyframe struct {
+		track    uint
+		timecode uint64
+		data     []byte
+	}
+	var got []keyframe
+	cast := newBroadcast(realClock{})
+	cast.OnKeyframe = func(track uint, timecode uint64, data []byte) {
+		got = append(got, keyframe{track, timecode, append([]byte{}, data...)})
+	}
+	testWrite(t, cast,
+		webmtest.Header(),
+		webmtest.Segment(),
+		webmtest.Info(1000000),
+		webmtest.Tracks(webmtest.Video(1, "V_VP8", 320, 240), webmtest.Audio(2, "A_OPUS")),
+		webmtest.Cluster(0),
+		webmtest.SimpleBlock(1, 0, true, []byte{1, 2, 3}),
+		webmtest.SimpleBlock(2, 0, true, []byte{4}),
+		webmtest.SimpleBlock(1, 40, false, []byte{5}),
+		webmtest.BlockGroup(1, 80, 0, []byte{6}),
+		webmtest.BlockGroup(1, 120, -40, []byte{7}),
+	)
+	expect := []keyframe{{1, 0, []byte{1, 2, 3}}, {1, 80, []byte{6}}}
+	if !reflect.DeepEqual(got, expect) {
+		t.Fatalf("%+v", got)
+	}
+}
+
+func TestSegmentChange(t *testing.T) {
+	cast := newBroadcast(realClock{})
+	ch := make(chan []byte, 100)
+	cast.Connect(ch, false, ^uint64(0))
+	testWrite(t, cast, testStream())
+	received(ch)
+	// Same tracks, so the viewer can go on decoding them without new headers.
+	testWrite(t, cast, webmtest.Header(), testStream()[len(webmtest.Header()):])
+	if chunks := received(ch); len(chunks) != 2 || bytes.Contains(chunks[0], []byte("V_VP8")) {
+		t.Fatalf("%x", chunks)
+	}
+	// The encoder has restarted with a different codec; the viewer must start over.
+	testWrite(t, cast,
+		webmtest.Header(),
+		webmtest.Segment(),
+		webmtest.Info(1000000),
+		webmtest.Tracks(webmtest.Video(1, "V_VP9", 640, 480)),
+		webmtest.Cluster(0),
+		webmtest.SimpleBlock(1, 0, false, []byte{6}),
+		webmtest.SimpleBlock(1, 40, true, []byte{7}),
+	)
+	chunks := received(ch)
+	if len(chunks) != 3 || !bytes.Equal(chunks[0], webmtest.Header()) || !bytes.Contains(chunks[1], []byte("V_VP9")) {
+		t.Fatalf("%x", chunks)
+	}
+	if !bytes.HasSuffix(chunks[2], webmtest.SimpleBlock(1, 40, true, []byte{7})) {
+		t.Fatalf("the first block is not a keyframe: %x", chunks[2])
+	}
+}
+
+func TestMetadataChange(t *testing.T) {
+	segment := func(tracks ...[]byte) []byte {
+		return webmtest.Cat(
+			webmtest.Header(),
+			webmtest.Segment(),
+			webmtest.Info(1000000),
+			webmtest.Tracks(tracks...),
+			webmtest.Cluster(0),
+			webmtest.SimpleBlock(1, 0, true, []byte{1}),
+		)
+	}
+	changes := 0
+	cast := newBroadcast(realClock{})
+	cast.OnMetadataChange = func() { changes++ }
+	testWrite(t, cast, segment(webmtest.Video(1, "V_VP8", 640, 480)))
+	testWrite(t, cast, segment(webmtest.Video(1, "V_VP8", 640, 480)))
+	if changes != 0 {
+		t.Fatalf("called %d times without a change", changes)
+	}
+	testWrite(t, cast, segment(webmtest.Video(1, "V_VP8", 1280, 720)))
+	if changes != 1 || cast.Width != 1280 || cast.Height != 720 {
+		t.Fatalf("called %d times, now %dx%d", changes, cast.Width, cast.Height)
+	}
+	testWrite(t, cast, segment(webmtest.Video(1, "V_VP8", 1280, 720), webmtest.Audio(2, "A_OPUS")))
+	if changes != 2 || !cast.HasAudio {
+		t.Fatalf("called %d times after adding audio", changes)
+	}
+}
+
+func TestTrackMask(t *testing.T) {
+	cast := newBroadcast(realClock{})
+	ch := make(chan []byte, 100)
+	cast.Connect(ch, false, 1<<2)
+	testWrite(t, cast,
+		webmtest.Header(),
+		webmtest.Segment(),
+		webmtest.Info(1000000),
+		webmtest.Tracks(webmtest.Video(1, "V_VP8", 320, 240), webmtest.Audio(2, "A_OPUS")),
+		webmtest.Cluster(0),
+		webmtest.SimpleBlock(1, 0, true, []byte{1}),
+		webmtest.SimpleBlock(2, 0, true, []byte{2}),
+		webmtest.Cluster(1000),
+		webmtest.SimpleBlock(1, 0, true, []byte{3}),
+		webmtest.SimpleBlock(2, 0, true, []byte{4}),
+	)
+	chunks := received(ch)
+	// All of the track info is still there, so the player knows what it's getting.
+	if len(chunks) != 4 || !bytes.Contains(chunks[1], []byte("V_VP8")) || !bytes.Contains(chunks[1], []byte("A_OPUS")) {
+		t.Fatalf("%x", chunks)
+	}
+	// The clusters of skipped blocks are not, but those of the audio blocks are.
+	for i, expect := range []struct {
+		timecode uint64
+		payload  byte
+	}{{0, 2}, {1000, 4}} {
+		chunk := chunks[2+i]
+		if !bytes.HasPrefix(chunk, []byte{0x1F, 0x43, 0xB6, 0x75}) || fixedUint(chunk[7:15]) != expect.timecode {
+			t.Fatalf("no cluster: %x", chunk)
+		}
+		if !bytes.Equal(chunk[15:], webmtest.SimpleBlock(2, 0, true, []byte{expect.payload})) {
+			t.Fatalf("not an audio block: %x", chunk)
+		}
+	}
+}
+
+func TestKeyframesOnly(t *testing.T) {
+	cast := newBroadcast(realClock{})
+	ch := make(chan []byte, 100)
+	cast.Connect(ch, false, ^uint64(0))
+	cast.KeyframesOnly(ch, true)
+	testWrite(t, cast,
+		webmtest.Header(),
+		webmtest.Segment(),
+		webmtest.Info(1000000),
+		webmtest.Tracks(webmtest.Video(1, "V_VP8", 320, 240)),
+		webmtest.Cluster(0),
+		webmtest.SimpleBlock(1, 0, true, []byte{1}),
+		webmtest.SimpleBlock(1, 40, false, []byte{2}),
+		webmtest.Cluster(1000),
+		webmtest.SimpleBlock(1, 0, false, []byte{3}),
+		webmtest.SimpleBlock(1, 40, true, []byte{4}),
+		webmtest.SimpleBlock(1, 80, false, []byte{5}),
+	)
+	chunks := received(ch)
+	if len(chunks) != 4 {
+		t.Fatalf("%x", chunks)
+	}
+	// The delta frames are gone, but each keyframe still comes with its cluster.
+	for i, expect := range []struct {
+		timecode uint64
+		block    []byte
+	}{{0, webmtest.SimpleBlock(1, 0, true, []byte{1})}, {1000, webmtest.SimpleBlock(1, 40, true, []byte{4})}} {
+		chunk := chunks[2+i]
+		if !bytes.HasPrefix(chunk, []byte{0x1F, 0x43, 0xB6, 0x75}) || fixedUint(chunk[7:15]) != expect.timecode {
+			t.Fatalf("no cluster: %x", chunk)
+		}
+		if !bytes.Equal(chunk[15:], expect.block) {
+			t.Fatalf("not a keyframe: %x", chunk)
+		}
+	}
+}
+
+func TestEndOfStream(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0), c: make(chan time.Time)}
+	closed := make(chan string, 1)
+	set := BroadcastSet{
+		Clock:             clock,
+		Timeout:           time.Second,
+		TickInterval:      time.Second,
+		OnStreamTrackInfo: func(string, *StreamTrackInfo) {},
+		OnStreamClose:     func(id string) { closed <- id },
+	}
+	defer set.Shutdown(context.Background())
+	cast, _ := set.Writable("test")
+	testWrite(t, cast, testStream())
+	var viewers []chan []byte
+	for i := 0; i < 2; i++ {
+		ch := make(chan []byte, 100)
+		cast.Connect(ch, false, ^uint64(0))
+		viewers = append(viewers, ch)
+	}
+	testWrite(t, cast, webmtest.SimpleBlock(1, 80, true, []byte{6}))
+	cast.Close()
+wait:
+	for {
+		select {
+		case <-closed:
+			break wait
+		case clock.c <- clock.advance(time.Second):
+		}
+	}
+	for i, ch := range viewers {
+		chunks := received(ch)
+		if len(chunks) == 0 || len(chunks[len(chunks)-1]) != 0 {
+			t.Fatalf("viewer %d: no end-of-stream marker", i)
+		}
+		for _, chunk := range chunks[:len(chunks)-1] {
+			if len(chunk) == 0 {
+				t.Fatalf("viewer %d: more than one end-of-stream marker", i)
+			}
+		}
+	}
+	// Ending a viewer twice must not send a second marker, as that would be taken for data.
+	var chunks [][]byte
+	cb := &viewer{write: func(data []byte) bool { chunks = append(chunks, data); return true }}
+	cb.end()
+	cb.end()
+	if len(chunks) != 1 || len(chunks[0]) != 0 {
+		t.Fatalf("%x", chunks)
+	}
+}
+
+func TestFrameRate(t *testing.T) {
+	for _, c := range []struct {
+		duration uint64 // Of a video frame, in nanoseconds; 0 if not given.
+		min, max float64
+	}{{33333333, 29.99, 30.01}, {16683350, 59.93, 59.95}, {0, 0, 0}} {
+		video := []byte{}
+		if c.duration != 0 {
+			video = webmtest.Uint(webmtest.TagDefaultDuration, c.duration)
+		}
+		cast := newBroadcast(realClock{})
+		testWrite(t, cast,
+			webmtest.Header(),
+			webmtest.Segment(),
+			webmtest.Info(1000000),
+			webmtest.Tracks(
+				// 20 ms Opus frames, which say nothing about the video.
+				webmtest.Tag(webmtest.TagTrackEntry, webmtest.Uint(webmtest.TagTrackNumber, 1), webmtest.Uint(webmtest.TagTrackType, webmtest.TypeAudio),
+					webmtest.String(webmtest.TagCodecID, "A_OPUS"), webmtest.Uint(webmtest.TagDefaultDuration, 20000000)),
+				webmtest.Tag(webmtest.TagTrackEntry, webmtest.Uint(webmtest.TagTrackNumber, 2), webmtest.Uint(webmtest.TagTrackType, webmtest.TypeVideo),
+					webmtest.String(webmtest.TagCodecID, "V_VP8"), video),
+			),
+		)
+		if cast.FrameRate < c.min || cast.FrameRate > c.max {
+			t.Fatalf("%d ns per frame: %f fps", c.duration, cast.FrameRate)
+		}
+	}
+}
+
+func TestUndeclaredTrack(t *testing.T) {
+	cast := newBroadcast(realClock{})
+	testWrite(t, cast,
+		webmtest.Header(),
+		webmtest.Segment(),
+		webmtest.Info(1000000),
+		webmtest.Tracks(webmtest.Video(1, "V_VP8", 320, 240), webmtest.Audio(2, "A_OPUS")),
+		webmtest.Cluster(0),
+		webmtest.SimpleBlock(2, 0, true, []byte{1}),
+	)
+	for _, block := range [][]byte{
+		webmtest.SimpleBlock(5, 0, true, []byte{2}),
+		webmtest.BlockGroup(5, 0, 0, []byte{2}),
+		webmtest.SimpleBlock(64, 0, true, []byte{2}),
+	} {
+		if _, err := cast.Write(block); err == nil {
+			t.Fatalf("accepted %x", block)
+		}
+		cast.Reset()
+	}
+	testWrite(t, cast, webmtest.SimpleBlock(2, 20, true, []byte{5}))
+	// Tracks are declared per segment.
+	testWrite(t, cast,
+		webmtest.Header(),
+		webmtest.Segment(),
+		webmtest.Info(1000000),
+		webmtest.Tracks(webmtest.Video(5, "V_VP8", 320, 240)),
+		webmtest.Cluster(0),
+		webmtest.SimpleBlock(5, 0, true, []byte{3}),
+	)
+	if _, err := cast.Write(webmtest.SimpleBlock(1, 0, true, []byte{4})); err == nil {
+		t.Fatal("accepted a block for a track of the previous segment")
+	}
+}
+
+func TestLacing(t *testing.T) {
+	x := bytes.Repeat([]byte{'x'}, 256)
+	for _, c := range []struct {
+		lacing byte
+		data   []byte
+		expect []string // nil if malformed.
+	}{
+		{0, []byte("abc"), []string{"abc"}},
+		{1, append([]byte{2, 1, 2}, "abbccc"...), []string{"a", "bb", "ccc"}},
+		{1, append(append([]byte{1, 255, 1}, x...), 'y'), []string{string(x), "y"}},
+		{1, []byte{2, 5}, nil},
+		{2, []byte{2, 'a', 'b', 'c'}, []string{"a", "b", "c"}},
+		{2, []byte{1, 'a', 'b', 'c'}, nil},
+		// Sizes 1 and 1 + 2, with the difference biased by 63.
+		{3, append([]byte{2, 0x81, 0x80 | 65}, "abbbcc"...), []string{"a", "bbb", "cc"}},
+		{3, append([]byte{2, 0x81, 0x80 | 60}, "abbbcc"...), nil},
+		{3, []byte{}, nil},
+	} {
+		frames, err := ebmlSplitLaces(c.lacing, c.data)
+		var got []string
+		for _, frame := range frames {
+			got = append(got, string(frame))
+		}
+		if c.expect == nil && err == nil || c.expect != nil && !reflect.DeepEqual(got, c.expect) {
+			t.Fatalf("lacing %d, %x: %q, %v", c.lacing, c.data, got, err)
+		}
+	}
+
+	var keyframes []string
+	cast := newBroadcast(realClock{})
+	cast.OnKeyframe = func(track uint, timecode uint64, data []byte) { keyframes = append(keyframes, string(data)) }
+	ch := make(chan []byte, 100)
+	cast.Connect(ch, false, ^uint64(0))
+	// A keyframe with fixed-size lacing (0x80 | 2 << 1), containing "a" and "b".
+	laced := webmtest.Tag(webmtest.TagSimpleBlock, []byte{0x81, 0, 0, 0x84, 1, 'a', 'b'})
+	testWrite(t, cast,
+		webmtest.Header(),
+		webmtest.Segment(),
+		webmtest.Info(1000000),
+		webmtest.Tracks(webmtest.Video(1, "V_VP8", 320, 240)),
+		webmtest.Cluster(0),
+		laced,
+	)
+	if !reflect.DeepEqual(keyframes, []string{"a", "b"}) {
+		t.Fatalf("%q", keyframes)
+	}
+	if chunks := received(ch); len(chunks) != 3 || !bytes.HasSuffix(chunks[2], laced) {
+		t.Fatalf("%x", chunks)
+	}
+	// Viewers should not get frames that don't add up to the block.
+	if _, err := cast.Write(webmtest.Tag(webmtest.TagSimpleBlock, []byte{0x81, 0, 0, 0x84, 1, 'a', 'b', 'c'})); err == nil {
+		t.Fatal("accepted a block with malformed lacing")
+	}
+	if chunks := received(ch); len(chunks) != 0 {
+		t.Fatalf("%x", chunks)
+	}
+}
+
+func TestTickInterval(t *testing.T) {
+	for _, interval := range []time.Duration{100 * time.Millisecond, time.Second, 2 * time.Second} {
+		clock := &fakeClock{now: time.Unix(1000, 0), c: make(chan time.Time)}
+		set := BroadcastSet{Clock: clock, Timeout: time.Hour, TickInterval: interval, OnStreamTrackInfo: func(string, *StreamTrackInfo) {}}
+		cast, _ := set.Writable("test")
+		// About 1000 bytes per second, whatever the interval.
+		void := webmtest.Tag(0xEC, make([]byte, int(1000*interval.Seconds())))
+		rate := float64(len(void)) / interval.Seconds()
+		for elapsed := time.Duration(0); elapsed < 30*time.Second; elapsed += interval {
+			testWrite(t, cast, void)
+			clock.tick(interval)
+			// Wait for the tick to be accounted for, else the next write may count towards it.
+			for {
+				cast.lock.Lock()
+				n := cast.rateUnit
+				cast.lock.Unlock()
+				if n == 0 {
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}
+		// Then nothing for two seconds, which should leave a quarter of the estimate.
+		for elapsed := time.Duration(0); elapsed < 2*time.Second; elapsed += interval {
+			clock.tick(interval)
+		}
+		set.Shutdown(context.Background())
+		if mean := cast.RateMean; mean < rate/4*0.99 || mean > rate/4*1.01 {
+			t.Fatalf("%v: %f bytes per second, expected %f", interval, mean, rate/4)
+		}
+	}
+}
+
+func TestNoEmptyClusters(t *testing.T) {
+	cast := newBroadcast(realClock{})
+	ch := make(chan []byte, 3)
+	cast.Connect(ch, false, ^uint64(0))
+	testWrite(t, cast, webmtest.Header(), webmtest.Segment(), webmtest.Info(1000000),
+		webmtest.Tracks(webmtest.Video(1, "V_VP8", 320, 240)))
+	// There is room for one more chunk, which must have both the cluster and the block.
+	key := webmtest.SimpleBlock(1, 0, true, []byte{1})
+	testWrite(t, cast, webmtest.Cluster(0), key)
+	chunks := received(ch)
+	if len(chunks) != 3 || !bytes.HasPrefix(chunks[2], []byte{0x1F, 0x43, 0xB6, 0x75}) || !bytes.HasSuffix(chunks[2], key) {
+		t.Fatalf("expected the headers and a cluster with the keyframe, got %x", chunks)
+	}
+	delta := webmtest.SimpleBlock(1, 40, false, []byte{2})
+	testWrite(t, cast, delta)
+	if chunks := received(ch); len(chunks) != 1 || !bytes.Equal(chunks[0], delta) {
+		t.Fatalf("expected only the block, got %x", chunks)
+	}
+}
+
+func TestConnectContext(t *testing.T) {
+	cast := newBroadcast(realClock{})
+	c, cancel := context.WithCancel(context.Background())
+	ch := make(chan []byte, 10)
+	cast.ConnectContext(c, ch, false, ^uint64(0))
+	if cast.ViewerCount() != 1 {
+		t.Fatal("not connected")
+	}
+	cancel()
+	for start := time.Now(); cast.ViewerCount() != 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatal("not disconnected")
+		}
+	}
+	// Nothing is sent once disconnected.
+	testWrite(t, cast, testStream())
+	if chunks := received(ch); len(chunks) != 0 {
+		t.Fatalf("%x", chunks)
+	}
+}
+
+func TestCloseTimeout(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0), c: make(chan time.Time)}
+	closed := make(chan string, 1)
+	set := BroadcastSet{
+		Clock:             clock,
+		Timeout:           3 * time.Second,
+		TickInterval:      time.Second,
+		OnStreamTrackInfo: func(string, *StreamTrackInfo) {},
+		OnStreamClose:     func(id string) { closed <- id },
+	}
+	defer set.Shutdown(context.Background())
+	cast, _ := set.Writable("test")
+	if !cast.Created.Equal(clock.Now()) {
+		t.Fatal(cast.Created)
+	}
+	clock.advance(5 * time.Second)
+	if uptime := cast.Stats().Uptime; uptime != 5*time.Second {
+		t.Fatal(uptime)
+	}
+	cast.Close()
+	// The stream is destroyed on the first tick after `Timeout` has passed. A tick is
+	// only received once the previous one has been handled.
+	for i := 0; i < 4; i++ {
+		select {
+		case clock.c <- clock.advance(time.Second):
+		case <-closed:
+			t.Fatal("closed after ", i, " ticks")
+		}
+	}
+	select {
+	case id := <-closed:
+		if id != "test" {
+			t.Fatal(id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("not closed after 4 ticks")
+	}
+}
+
+func TestReadableLive(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0), c: make(chan time.Time)}
+	set := BroadcastSet{
+		Clock:             clock,
+		Timeout:           3 * time.Second,
+		TickInterval:      time.Second,
+		OnStreamTrackInfo: func(string, *StreamTrackInfo) {},
+	}
+	defer set.Shutdown(context.Background())
+	cast, _ := set.Writable("test")
+	if c, ok := set.ReadableLive("test"); !ok || c != cast {
+		t.Fatal("a live stream is not readable")
+	}
+	cast.Close()
+	clock.tick(time.Second)
+	if _, ok := set.ReadableLive("test"); ok {
+		t.Fatal("a closing stream is readable")
+	}
+	// Still there for anyone who wants to look at it anyway.
+	if c, ok := set.Readable("test"); !ok || c != cast {
+		t.Fatal("a closing stream is gone")
+	}
+	// The broadcaster is back before the countdown has ended.
+	if c, ok := set.Writable("test"); !ok || c != cast {
+		t.Fatal("could not reopen the stream")
+	}
+	if c, ok := set.ReadableLive("test"); !ok || c != cast {
+		t.Fatal("a reopened stream is not readable")
+	}
+	if _, ok := set.ReadableLive("other"); ok {
+		t.Fatal("a nonexistent stream is readable")
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	cast := newBroadcast(clock)
+	fast, slow := make(chan []byte, 1000), make(chan []byte, 1000)
+	cast.Connect(fast, false, ^uint64(0))
+	cast.Connect(slow, false, ^uint64(0))
+	cast.Throttle(slow, 1000)
+	testWrite(t, cast, webmtest.Header(), webmtest.Segment(), webmtest.Info(1000000),
+		webmtest.Tracks(webmtest.Video(1, "V_VP8", 320, 240)))
+	// 10 seconds of 2 KB/s with a keyframe every second.
+	for i := 0; i < 100; i++ {
+		clock.advance(100 * time.Millisecond)
+		testWrite(t, cast, webmtest.Cluster(uint64(i*100)), webmtest.SimpleBlock(1, 0, i%10 == 0, make([]byte, 200)))
+	}
+	total := func(ch chan []byte) (n int) {
+		for _, chunk := range received(ch) {
+			n += len(chunk)
+		}
+		return n
+	}
+	nfast, nslow := total(fast), total(slow)
+	// The initial allowance, 10 seconds' worth, and one chunk of overshoot at most.
+	if nfast < 20000 || nslow > 11300 || nslow < 5000 {
+		t.Fatal(nfast, nslow)
+	}
+}
+
+func TestTagBounds(t *testing.T) {
+	data := []byte{0xEC, 0x82, 1, 2, 3}
+	if tag := ebmlParseTag(data); tag.ID != ebmlTagVoid || !bytes.Equal(tag.Contents(data), []byte{1, 2}) || !bytes.Equal(tag.Skip(data), []byte{3}) {
+		t.Fatal(tag)
+	}
+	for _, tag := range []ebmlTag{
+		{2, ebmlTagVoid, 4},
+		{2, ebmlTagVoid, ebmlIndeterminate},
+		{2, ebmlTagVoid, ^uint64(0)},
+		{2, ebmlTagVoid, ^uint64(0) - 1},
+		{6, ebmlTagVoid, 0},
+	} {
+		if tag.Contents(data) != nil || tag.Skip(data) != nil {
+			t.Fatal(tag)
+		}
+	}
+	for _, data := range [][]byte{
+		{0xEC, 0x83, 1, 2},
+		{0xEC, 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFE, 1},
+		{0xEC},
+		{0xEC, 0x40},
+	} {
+		if tag := ebmlParseTag(data); tag.ID != 0 || tag.Consumed != 0 {
+			t.Fatalf("%x: %v", data, tag)
+		}
+	}
+	// Tags nested in complete ones are checked just the same.
+	for _, data := range [][]byte{
+		webmtest.Tag(webmtest.TagInfo, []byte{0x2A, 0xD7, 0xB1, 0x88, 1}),
+		webmtest.Tag(webmtest.TagInfo, []byte{0x2A, 0xD7, 0xB1, 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFE, 1}),
+		webmtest.Tracks(webmtest.Tag(webmtest.TagTrackEntry, []byte{0xE0, 0x88, 0xB0, 0x81})),
+		webmtest.Tracks(webmtest.Tag(webmtest.TagTrackEntry, []byte{0xD7, 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFE, 1})),
+	} {
+		cast := newBroadcast(realClock{})
+		if _, err := cast.Write(webmtest.Cat(webmtest.Header(), webmtest.Segment(), data)); err == nil {
+			t.Fatalf("accepted %x", data)
+		}
+	}
+}
+
+func TestFinalizeCues(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "test.webm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	cast := newBroadcast(realClock{})
+	if err = cast.StartRecording(f); err != nil {
+		t.Fatal(err)
+	}
+	testWrite(t, cast, webmtest.Header(), webmtest.Segment(), webmtest.Info(1000000),
+		webmtest.Tracks(webmtest.Video(1, "V_VP8", 320, 240)))
+	// A keyframe every 3 seconds.
+	for i := 0; i < 10; i++ {
+		testWrite(t, cast, webmtest.Cluster(uint64(i*1000)),
+			webmtest.SimpleBlock(1, 0, i%3 == 0, []byte{1, 2, 3}),
+			webmtest.SimpleBlock(1, 40, false, []byte{4, 5}))
+	}
+	if err = cast.FinalizeCues(f); err == nil {
+		t.Fatal("finalized while still recording")
+	}
+	if err = cast.StopRecording(); err != nil {
+		t.Fatal(err)
+	}
+	if err = cast.FinalizeCues(f); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ParseStream(bytes.NewReader(data)); err != nil {
+		t.Fatal("the recording is not valid: ", err)
+	}
+	// The contents of the first child of a tag with a given ID, nil if none.
+	child := func(data []byte, id uint) []byte {
+		for len(data) != 0 {
+			tag := ebmlParseTag(data)
+			if tag.ID == 0 {
+				return nil
+			} else if tag.ID == id {
+				return tag.Contents(data)
+			}
+			data = tag.Skip(data)
+		}
+		return nil
+	}
+	segment := child(data, ebmlTagSegment)
+	if segment == nil {
+		t.Fatal("the Segment should have a known length now")
+	}
+	seek := child(child(segment, ebmlTagSeekHead), ebmlTagSeek)
+	if !bytes.Equal(child(seek, ebmlTagSeekID), []byte{0x1C, 0x53, 0xBB, 0x6B}) {
+		t.Fatalf("the SeekHead does not point to Cues: %x", seek)
+	}
+	cues := segment[fixedUint(child(seek, ebmlTagSeekPosition)):]
+	if ebmlParseTag(cues).ID != ebmlTagCues {
+		t.Fatalf("not Cues: %x", cues)
+	}
+	n := 0
+	for points := child(cues, ebmlTagCues); len(points) != 0; n++ {
+		tag := ebmlParseTag(points)
+		point := tag.Contents(points)
+		pos := child(point, ebmlTagCueTrackPos)
+		if tc := fixedUint(child(point, ebmlTagCueTime)); tc != uint64(n*3000) {
+			t.Fatal("wrong time: ", tc)
+		}
+		if track := fixedUint(child(pos, ebmlTagCueTrack)); track != 1 {
+			t.Fatal("wrong track: ", track)
+		}
+		if cluster := fixedUint(child(pos, ebmlTagCueClusterPos)); ebmlParseTagIncomplete(segment[cluster:]).ID != ebmlTagCluster {
+			t.Fatal("not a cluster at ", cluster)
+		}
+		points = tag.Skip(points)
+	}
+	if n != 4 {
+		t.Fatal("expected 4 cue points, got ", n)
+	}
+}
+
+func TestMaxStreams(t *testing.T) {
+	set := BroadcastSet{MaxStreams: 2, Timeout: time.Hour, OnStreamTrackInfo: func(string, *StreamTrackInfo) {}}
+	defer set.Shutdown(context.Background())
+	a, ok := set.Writable("a")
+	if !ok || set.Full() {
+		t.Fatal("refused the first stream")
+	}
+	if _, ok = set.Writable("b"); !ok || !set.Full() {
+		t.Fatal("refused the second stream")
+	}
+	if c, ok := set.Writable("c"); ok || c != nil {
+		t.Fatal("accepted a third stream")
+	}
+	if _, _, ok := set.WritableForce("c"); ok {
+		t.Fatal("accepted a third stream by force")
+	}
+	// The existing ones still work, including after a reconnect.
+	testWrite(t, a, testStream())
+	a.Close()
+	if again, ok := set.Writable("a"); !ok || again != a {
+		t.Fatal("could not reopen a stream")
+	}
+	if again, _, ok := set.WritableForce("a"); !ok || again != a {
+		t.Fatal("could not take over a stream")
+	}
+	testWrite(t, a, testStream())
+}
+
+func TestTap(t *testing.T) {
+	cast := newBroadcast(realClock{})
+	ch := make(chan []byte, 100)
+	cast.Connect(ch, false, ^uint64(0))
+	type tapped struct {
+		track    uint
+		keyframe bool
+		timecode uint64
+		block    []byte
+	}
+	var blocks []tapped
+	untap := cast.Tap(func(track uint, keyframe bool, timecode uint64, block []byte) {
+		blocks = append(blocks, tapped{track, keyframe, timecode, append([]byte{}, block...)})
+	})
+	testWrite(t, cast, webmtest.Header(), webmtest.Segment(), webmtest.Info(1000000),
+		webmtest.Tracks(webmtest.Video(1, "V_VP8", 320, 240), webmtest.Audio(2, "A_OPUS")))
+	for i := 0; i < 5; i++ {
+		testWrite(t, cast, webmtest.Cluster(uint64(i*100)),
+			webmtest.SimpleBlock(1, 0, i == 0, []byte{byte(i)}),
+			webmtest.SimpleBlock(2, 20, true, []byte{byte(i + 10)}),
+			webmtest.SimpleBlock(1, 40, false, []byte{byte(i + 20)}))
+	}
+	untap()
+	testWrite(t, cast, webmtest.Cluster(500), webmtest.SimpleBlock(1, 0, false, []byte{99}))
+	// The viewer gets the same blocks in the same order, some of them after a cluster,
+	// following the EBML header and the tracks.
+	var sent [][]byte
+	for _, chunk := range received(ch)[2:] {
+		if bytes.HasPrefix(chunk, []byte{0x1F, 0x43, 0xB6, 0x75}) {
+			chunk = chunk[15:]
+		}
+		sent = append(sent, chunk)
+	}
+	if len(blocks) != 15 || len(sent) != 16 {
+		t.Fatal(len(blocks), len(sent))
+	}
+	for i, b := range blocks {
+		track, keyframe, timecode := uint(1), i == 0, uint64(i/3*100)
+		switch i % 3 {
+		case 1:
+			track, keyframe, timecode = 2, true, timecode+20
+		case 2:
+			timecode += 40
+		}
+		if b.track != track || b.keyframe != keyframe || b.timecode != timecode || !bytes.Equal(b.block, sent[i]) {
+			t.Fatalf("block %d: %+v, sent %x", i, b, sent[i])
+		}
+	}
+}
+
+func TestBlockBeforeTracks(t *testing.T) {
+	for _, c := range []struct {
+		data []byte
+		err  string
+	}{
+		{webmtest.Cat(webmtest.Header(), webmtest.Segment(), webmtest.Cluster(0),
+			webmtest.SimpleBlock(1, 0, true, []byte{1})), "Tracks required before the first block"},
+		{webmtest.Cat(webmtest.Segment(), webmtest.Info(1000000), webmtest.Tracks(webmtest.Video(1, "V_VP8", 320, 240)),
+			webmtest.Cluster(0), webmtest.SimpleBlock(1, 0, true, []byte{1})), "EBML header required before the first block"},
+	} {
+		cast := newBroadcast(realClock{})
+		ch := make(chan []byte, 10)
+		cast.Connect(ch, false, ^uint64(0))
+		if _, err := cast.Write(c.data); err == nil || err.Error() != c.err {
+			t.Fatal(err)
+		}
+		if chunks := received(ch); len(chunks) != 0 {
+			t.Fatalf("sent %x", chunks)
+		}
+	}
+}
+
+func TestTrackNames(t *testing.T) {
+	audio := func(number uint64, tags ...[]byte) []byte {
+		return webmtest.Tag(webmtest.TagTrackEntry, append([][]byte{
+			webmtest.Uint(webmtest.TagTrackNumber, number),
+			webmtest.Uint(webmtest.TagTrackType, webmtest.TypeAudio),
+			webmtest.String(webmtest.TagCodecID, "A_OPUS"),
+		}, tags...)...)
+	}
+	cast := newBroadcast(realClock{})
+	testWrite(t, cast, webmtest.Header(), webmtest.Segment(), webmtest.Info(1000000), webmtest.Tracks(
+		audio(1, webmtest.String(ebmlTagName, "English"), webmtest.String(ebmlTagLanguage, "eng")),
+		// The IETF tag takes precedence over the older ISO 639-2 one, wherever it is.
+		audio(2, webmtest.String(ebmlTagLanguageIETF, "pt-BR"), webmtest.String(ebmlTagName, "Português"),
+			webmtest.String(ebmlTagLanguage, "por")),
+		audio(3),
+	))
+	expect := [][2]string{{"English", "eng"}, {"Português", "pt-BR"}, {"", ""}}
+	if len(cast.Tracks) != len(expect) {
+		t.Fatal(cast.Tracks)
+	}
+	for i, track := range cast.Tracks {
+		if track.Name != expect[i][0] || track.Language != expect[i][1] {
+			t.Fatal(cast.Tracks)
+		}
+	}
+}
+
+func TestSegmentInfo(t *testing.T) {
+	cast := newBroadcast(realClock{})
+	testWrite(t, cast, webmtest.Header(), webmtest.Segment(), webmtest.Tag(webmtest.TagInfo,
+		webmtest.Uint(webmtest.TagTimecodeScale, 1000000),
+		webmtest.String(ebmlTagMuxingApp, "Lavf58.76.100"),
+		webmtest.String(ebmlTagWritingApp, "OBS Studio 30.0"),
+		webmtest.Uint(ebmlTagDateUTC, uint64(time.Hour)),
+	), webmtest.Tracks(webmtest.Audio(1, "A_OPUS")))
+	if cast.MuxingApp != "Lavf58.76.100" || cast.WritingApp != "OBS Studio 30.0" {
+		t.Fatalf("muxing app %q, writing app %q", cast.MuxingApp, cast.WritingApp)
+	}
+	if expect := time.Date(2001, 1, 1, 1, 0, 0, 0, time.UTC); !cast.DateUTC.Equal(expect) {
+		t.Fatalf("date %v, expected %v", cast.DateUTC, expect)
+	}
+	// A new segment from a different encoder may not say anything about itself.
+	testWrite(t, cast, webmtest.Segment(), webmtest.Info(1000000))
+	if cast.MuxingApp != "" || cast.WritingApp != "" || !cast.DateUTC.IsZero() {
+		t.Fatalf("not reset: %q, %q, %v", cast.MuxingApp, cast.WritingApp, cast.DateUTC)
+	}
+}
+
+func TestAllowedCodecs(t *testing.T) {
+	stream := func(codec string) []byte {
+		return webmtest.Cat(webmtest.Header(), webmtest.Segment(), webmtest.Info(1000000),
+			webmtest.Tracks(webmtest.Video(1, codec, 320, 240)))
+	}
+	cast := newBroadcast(realClock{})
+	cast.AllowedCodecs = []string{"V_VP8", "V_VP9"}
+	testWrite(t, cast, stream("V_VP9"))
+	if _, err := cast.Write(stream("V_AV1")); err == nil || !strings.Contains(err.Error(), "V_AV1") {
+		t.Fatalf("V_AV1 not rejected: %v", err)
+	}
+	// No list means anything goes.
+	cast = newBroadcast(realClock{})
+	testWrite(t, cast, stream("V_AV1"))
+}
+
+func TestCloseReasons(t *testing.T) {
+	for _, expect := range []CloseReason{CloseTimeout, CloseIdle, CloseShutdown} {
+		clock := &fakeClock{now: time.Unix(1000, 0), c: make(chan time.Time)}
+		var order []string
+		done := make(chan CloseReason, 1)
+		set := BroadcastSet{
+			Clock:             clock,
+			Timeout:           time.Second,
+			IdleTimeout:       3 * time.Second,
+			TickInterval:      time.Second,
+			OnStreamTrackInfo: func(string, *StreamTrackInfo) {},
+			OnStreamCloseReason: func(id string, r CloseReason) {
+				order = append(order, "reason")
+				done <- r
+			},
+			OnStreamClose: func(id string) { order = append(order, "close") },
+		}
+		cast, _ := set.Writable("test")
+		switch expect {
+		case CloseTimeout:
+			cast.Close()
+		case CloseShutdown:
+			set.Shutdown(context.Background())
+		}
+		var reason CloseReason
+	wait:
+		for {
+			select {
+			case reason = <-done:
+				break wait
+			case clock.c <- clock.advance(time.Second):
+			}
+		}
+		// (This also waits for `OnStreamClose`.)
+		set.Shutdown(context.Background())
+		if reason != expect {
+			t.Fatal("expected ", expect, ", got ", reason)
+		}
+		if len(order) != 2 || order[0] != "reason" || order[1] != "close" {
+			t.Fatal(order)
+		}
+	}
+}
+
+func TestEvictReason(t *testing.T) {
+	evicted := make(chan string, 1)
+	closed := make(chan CloseReason, 1)
+	set := BroadcastSet{
+		Timeout:             time.Hour,
+		OnStreamTrackInfo:   func(string, *StreamTrackInfo) {},
+		OnStreamEvict:       func(id string) { evicted <- id },
+		OnStreamCloseReason: func(id string, r CloseReason) { closed <- r },
+	}
+	set.Writable("test")
+	if _, _, ok := set.WritableForce("test"); !ok {
+		t.Fatal("not taken over")
+	}
+	if id := <-evicted; id != "test" {
+		t.Fatal(id)
+	}
+	select {
+	case r := <-closed:
+		t.Fatal("closed by eviction: ", r)
+	default:
+	}
+	set.Shutdown(context.Background())
+	if r := <-closed; r != CloseShutdown {
+		t.Fatal(r)
+	}
+}
+
+func TestCloseReasonStrings(t *testing.T) {
+	for reason, name := range map[CloseReason]string{
+		CloseTimeout:       "timeout",
+		CloseIdle:          "idle",
+		CloseShutdown:      "shutdown",
+		CloseDurationLimit: "duration limit",
+		CloseReason(-1):    "unknown",
+	} {
+		if reason.String() != name {
+			t.Fatal(int(reason), reason.String())
+		}
+	}
+}
@@ -5,20 +5,95 @@ import (
 	"errors"
 	"github.com/powerman/rpc-codec/jsonrpc2"
 	"golang.org/x/net/websocket"
+	"log"
 	"net/rpc"
+	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 type Chat struct {
-	events  chan interface{}
-	Users   map[*chatter]struct{}
-	History ChatMessageQueue
+	// Minimum number of seconds between messages of a single user, set by the streamer
+	// at any time with `SetSlowMode`. Accessed atomically, so it goes first for alignment.
+	slowMode int64
+	events   chan interface{}
+	done     chan struct{} // (Closed when `handle` returns.)
+	Users    map[*chatter]struct{}
+	names    map[string]*chatter
+	History  ChatMessageQueue
+	// How many messages a single user can send in 10 seconds. 0 means no limit.
+	RateLimit int
+	// Images that clients should show in place of ":name:" (name -> URL). Sent to each
+	// user upon connecting, so changing this only affects new ones.
+	Emotes map[string]string
+	// If nonzero, anonymous users who have not sent anything for this long lose their
+	// names, so that they can't hold on to them forever by leaving a tab open.
+	NameExpiry time.Duration
+	// How many users can be connected at once. 0 means no limit. The streamer is always
+	// let in; so are logged-in users if `AdmitLoggedIn` is set.
+	MaxUsers      int
+	AdmitLoggedIn bool
+	// Where to save messages to. May be nil, in which case the history is lost
+	// once the chat is closed.
+	db Database
+	id string
+	// Writes to `db`, done in order by `persist` so that a slow database does not hold
+	// up everyone in the room. (If it's too slow for this buffer, it does, though.)
+	saves chan func()
+	// The ID of the last message; they are numbered sequentially.
+	lastID int64
+	// The number of users as of the last `Stream.ViewerCount`. (Only accessed by `handle`.)
+	sentViewerCount int
+	// Logins of users not allowed to join.
+	banLock sync.Mutex
+	banned  map[string]struct{}
+	// See `SetBlockedWords`.
+	filterLock sync.Mutex
+	filter     *regexp.Regexp
+	censor     bool
 }
 
+// Codes of errors returned by `Chat` methods, so that clients can tell them apart
+// without looking at the messages. Anything else has the code -32000.
+const (
+	ChatErrorNoName      = 1 // `SetName` has not been called yet.
+	ChatErrorRateLimited = 2 // Too many messages or slow mode; try again later.
+	ChatErrorBanned      = 3
+	ChatErrorLength      = 4  // The message is empty or too long.
+	ChatErrorOwnerOnly   = 5  // Only the streamer can do that.
+	ChatErrorNameTaken   = 6  // By someone else in the chat, or a registered user.
+	ChatErrorBlocked     = 7  // The message contains blocked words.
+	ChatErrorFull        = 8  // See `Chat.MaxUsers`.
+	ChatErrorNoSuchUser  = 9  // Nobody in the chat has that name.
+	ChatErrorAnonymous   = 10 // Only logged-in users can be banned.
+)
+
+var (
+	errChatNoName       = jsonrpc2.NewError(ChatErrorNoName, "must obtain a name first")
+	errChatRateLimit    = jsonrpc2.NewError(ChatErrorRateLimited, "too many messages, slow down")
+	errChatSlowMode     = jsonrpc2.NewError(ChatErrorRateLimited, "slow mode is on, please wait")
+	errChatBanned       = jsonrpc2.NewError(ChatErrorBanned, "banned from this chat")
+	errChatLength       = jsonrpc2.NewError(ChatErrorLength, "message must have between 1 and 256 characters")
+	errChatOwnerOnly    = jsonrpc2.NewError(ChatErrorOwnerOnly, "only the streamer can do that")
+	errChatNameTaken    = jsonrpc2.NewError(ChatErrorNameTaken, "this name is already taken")
+	errChatNameReserved = jsonrpc2.NewError(ChatErrorNameTaken, "this name belongs to a registered user")
+	errChatBlocked      = jsonrpc2.NewError(ChatErrorBlocked, "this message contains blocked words")
+	errChatFull         = jsonrpc2.NewError(ChatErrorFull, "too many users in this chat")
+	errChatNoSuchUser   = jsonrpc2.NewError(ChatErrorNoSuchUser, "no such user")
+	errChatAnonymous    = jsonrpc2.NewError(ChatErrorAnonymous, "only logged-in users can be banned")
+)
+
 type ChatMessage struct {
-	name  string
-	login string
-	text  string
+	id     int64
+	name   string
+	login  string
+	text   string
+	action bool // IRC-style "/me does something"; `text` is without the "/me".
+	time   time.Time
 }
 
 type ChatMessageQueue struct {
@@ -27,14 +102,88 @@ type ChatMessageQueue struct {
 }
 
 type chatter struct {
-	name   string
+	// When this user last claimed a name or sent something, in Unix nanoseconds.
+	// Accessed atomically, so it goes first for alignment.
+	active int64
 	login  string
+	owner  bool // Whether this is the streamer, who can kick & ban people.
+	typing bool // (Only accessed by `Chat.handle`.)
 	socket *websocket.Conn
 	chat   *Chat
+	// Only changed by `Chat.handle`, which can read it freely. (RPC calls are concurrent
+	// with it, so they use `currentName`.)
+	nameLock sync.Mutex
+	name     string
+	// A token bucket for `Chat.RateLimit`. (RPC calls are concurrent.)
+	rateLock   sync.Mutex
+	rateTokens float64
+	lastSent   time.Time
+}
+
+type chatTypingEvent struct {
+	user   *chatter
+	typing bool
+}
+
+type chatSetNameEvent struct {
+	user  *chatter
+	name  string
+	reply chan<- error
+}
+
+// Deliver a private message to the user with a given name (and echo it back).
+type chatWhisperEvent struct {
+	user  *chatter
+	to    string
+	text  string
+	reply chan<- error
+}
+
+// Sent every second. Viewer counts are updated, and anonymous users inactive
+// for `NameExpiry` as of `now` lose their names.
+type chatTickEvent struct {
+	now time.Time
+}
+
+type chatJoinEvent struct {
+	user  *chatter
+	reply chan<- error
+}
+
+type chatLeaveEvent struct {
+	user *chatter
+}
+
+type chatOfflineEvent struct{}
+
+type chatHistorySizeEvent struct {
+	size int
+}
+
+type chatSlowModeEvent struct {
+	seconds int64
+}
+
+// Send a `Chat.UserList` to this user.
+type chatUserListEvent struct {
+	user *chatter
+}
+
+// Remove a message from history & notify everyone.
+type chatDeleteEvent struct {
+	id int64
+}
+
+// Disconnect everyone logged in as someone. If `ban` is set, also notify all users.
+type chatKickEvent struct {
+	login string
+	ban   bool
 }
 
 func (q *ChatMessageQueue) Push(x ChatMessage) {
-	if len(q.data) == cap(q.data) {
+	if cap(q.data) == 0 {
+		return
+	} else if len(q.data) == cap(q.data) {
 		q.data[q.start] = x
 		q.start = (q.start + 1) % len(q.data)
 	} else {
@@ -45,25 +194,112 @@ func (q *ChatMessageQueue) Push(x ChatMessage) {
 func (q *ChatMessageQueue) Iterate(f func(x ChatMessage) error) error {
 	// this should be safe to use without a mutex. at worst, pushing more than
 	// `cap(q.data)` messages while iterating may result in skipping over some of them.
-	for i, s, n := 0, q.start, len(q.data); i < n; i++ {
-		if err := f(q.data[(i+s)%n]); err != nil {
+	for i, s, data := 0, q.start, q.data; i < len(data); i++ {
+		if err := f(data[(i+s)%len(data)]); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func NewChat(qsize int) *Chat {
+func (q *ChatMessageQueue) Remove(id int64) {
+	// a new array, so that concurrent `Iterate`s are not disturbed.
+	data := make([]ChatMessage, 0, cap(q.data))
+	q.Iterate(func(x ChatMessage) error {
+		if x.id != id {
+			data = append(data, x)
+		}
+		return nil
+	})
+	q.data, q.start = data, 0
+}
+
+// Change the capacity of the queue, keeping as many of the most recent messages as fit.
+func (q *ChatMessageQueue) Resize(size int) {
+	data := make([]ChatMessage, 0, size)
+	skip := len(q.data) - size
+	q.Iterate(func(x ChatMessage) error {
+		if skip--; skip < 0 {
+			data = append(data, x)
+		}
+		return nil
+	})
+	q.data, q.start = data, 0
+}
+
+func NewChat(qsize int, id string, db Database) *Chat {
 	ctx := &Chat{
 		events:  make(chan interface{}),
+		done:    make(chan struct{}),
 		Users:   make(map[*chatter]struct{}),
+		names:   make(map[string]*chatter),
 		History: ChatMessageQueue{make([]ChatMessage, 0, qsize), 0},
+		db:      db,
+		id:      id,
+		banned:  make(map[string]struct{}),
+		saves:   make(chan func(), 256),
+	}
+	if db != nil {
+		msgs, err := db.RecentChatMessages(id, qsize)
+		if err != nil {
+			log.Println("Error loading chat history: ", err)
+		}
+		for _, msg := range msgs {
+			ctx.History.Push(msg)
+			ctx.lastID = msg.id
+		}
 	}
 	go ctx.handle()
+	go ctx.tick(time.Second)
+	go ctx.persist()
 	return ctx
 }
 
+func (c *Chat) persist() {
+	for {
+		select {
+		case save := <-c.saves:
+			save()
+		case <-c.done:
+			// `handle` won't add anything else, so only the rest of the buffer is left.
+			for {
+				select {
+				case save := <-c.saves:
+					save()
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// Run a database write in the background.
+func (c *Chat) save(f func()) {
+	select {
+	case c.saves <- f:
+	case <-c.done:
+		// Nobody is reading `saves` anymore (or will be soon), but this is not
+		// called from `handle`, so it can take its time.
+		f()
+	}
+}
+
+func (c *Chat) tick(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			c.send(chatTickEvent{now})
+		case <-c.done:
+			return
+		}
+	}
+}
+
 func (c *Chat) handle() {
+	defer close(c.done)
 	closed := false
 	for genericEvent := range c.events {
 		switch event := genericEvent.(type) {
@@ -76,63 +312,377 @@ func (c *Chat) handle() {
 				return // else must handle pending events first
 			}
 
-		case *chatter:
-			if _, exists := c.Users[event]; exists {
-				delete(c.Users, event)
-				if closed && len(c.Users) == 0 {
-					return // if these events were left unhandled, senders would block forever
+		case chatJoinEvent:
+			joined := event.user
+			if c.MaxUsers > 0 && len(c.Users) >= c.MaxUsers && !joined.owner && (joined.login == "" || !c.AdmitLoggedIn) {
+				event.reply <- errChatFull
+				break
+			}
+			c.Users[joined] = struct{}{}
+			event.reply <- nil
+			if joined.name != "" {
+				// logged in, so this always succeeds.
+				c.claimName(joined, joined.name)
+				joined.pushName()
+			}
+			if slow := atomic.LoadInt64(&c.slowMode); slow != 0 {
+				joined.pushSlowMode(slow)
+			}
+			if joined.login != "" {
+				for u := range c.Users {
+					// anonymous users come and go all the time; not worth mentioning.
+					if u != joined {
+						u.pushPresence(joined, true)
+					}
 				}
-			} else {
-				c.Users[event] = struct{}{}
 			}
+			// everyone else gets the new count on the next tick.
+			joined.pushViewerCount()
+
+		case chatLeaveEvent:
+			left := event.user
+			if _, ok := c.Users[left]; !ok {
+				break
+			}
+			delete(c.Users, left)
+			if closed && len(c.Users) == 0 {
+				return // if these events were left unhandled, senders would block forever
+			}
+			c.releaseName(left)
 			for u := range c.Users {
-				u.pushViewerCount()
+				if left.typing {
+					u.pushTyping(left, false)
+				}
+				if left.login != "" {
+					u.pushPresence(left, false)
+				}
+			}
+
+		case chatTypingEvent:
+			if _, ok := c.Users[event.user]; ok && event.user.typing != event.typing {
+				event.user.typing = event.typing
+				for u := range c.Users {
+					if u != event.user {
+						u.pushTyping(event.user, event.typing)
+					}
+				}
 			}
 
 		case ChatMessage:
+			c.lastID++
+			event.id = c.lastID
+			event.time = time.Now()
 			c.History.Push(event)
+			if c.db != nil {
+				c.save(func() {
+					if err := c.db.AppendChatMessage(c.id, event); err != nil {
+						log.Println("Error saving a chat message: ", err)
+					}
+				})
+			}
 			for u := range c.Users {
 				u.pushMessage(event)
 			}
+
+		case chatSetNameEvent:
+			if !c.claimName(event.user, event.name) {
+				event.reply <- errChatNameTaken
+			} else {
+				event.user.touch(time.Now())
+				event.user.pushName()
+				event.reply <- nil
+			}
+
+		case chatTickEvent:
+			// during a raid, sending a new count to everyone on each join would be
+			// quadratic, so this is only done once a second, and only if it's changed.
+			if len(c.Users) != c.sentViewerCount {
+				c.sentViewerCount = len(c.Users)
+				for u := range c.Users {
+					u.pushViewerCount()
+				}
+			}
+			if c.NameExpiry <= 0 {
+				break
+			}
+			for expired := range c.Users {
+				if expired.login != "" || expired.name == "" || event.now.Sub(expired.lastActive()) <= c.NameExpiry {
+					continue
+				}
+				if expired.typing {
+					expired.typing = false
+					for u := range c.Users {
+						if u != expired {
+							u.pushTyping(expired, false)
+						}
+					}
+				}
+				name := expired.name
+				c.releaseName(expired)
+				expired.setName("")
+				expired.pushNameExpired(name)
+			}
+
+		case chatWhisperEvent:
+			if target, ok := c.names[event.to]; !ok {
+				event.reply <- errChatNoSuchUser
+			} else {
+				target.pushWhisper(event.user, target.name, event.text)
+				if target != event.user {
+					event.user.pushWhisper(event.user, target.name, event.text)
+				}
+				event.reply <- nil
+			}
+
+		case chatHistorySizeEvent:
+			c.History.Resize(event.size)
+
+		case chatOfflineEvent:
+			for u := range c.Users {
+				u.pushOffline()
+			}
+
+		case chatSlowModeEvent:
+			for u := range c.Users {
+				u.pushSlowMode(event.seconds)
+			}
+
+		case chatUserListEvent:
+			users := make([][]string, 0, len(c.Users))
+			for u := range c.Users {
+				if u.name != "" {
+					users = append(users, []string{u.name, u.login})
+				}
+			}
+			event.user.pushUserList(users)
+
+		case chatDeleteEvent:
+			// the message may have already been pushed out of the queue,
+			// but clients may still be displaying it.
+			c.History.Remove(event.id)
+			if c.db != nil {
+				c.save(func() {
+					if err := c.db.DeleteChatMessage(c.id, event.id); err != nil {
+						log.Println("Error deleting a chat message: ", err)
+					}
+				})
+			}
+			for u := range c.Users {
+				u.pushDeletion(event.id)
+			}
+
+		case chatKickEvent:
+			for u := range c.Users {
+				if u.login == event.login {
+					// `RunRPC` will then call `Disconnect`.
+					u.socket.Close()
+				}
+			}
+			if event.ban {
+				for u := range c.Users {
+					u.pushBan(event.login)
+				}
+			}
 		}
 	}
 }
 
-func (c *Chat) Connect(ws *websocket.Conn, auth *UserData) *chatter {
-	chatter := &chatter{socket: ws, chat: c}
+// Give a name to a user. Logged-in users take precedence: an anonymous user who had
+// the name loses it, while two logged-in ones can share it (logins are still unique).
+// Returns false if someone else has the name.
+func (c *Chat) claimName(u *chatter, name string) bool {
+	if holder, ok := c.names[name]; ok && holder != u {
+		if u.login == "" {
+			return false
+		}
+		if holder.login == "" {
+			holder.setName("")
+			holder.pushNameTaken(name)
+		}
+	}
+	c.releaseName(u)
+	u.setName(name)
+	c.names[name] = u
+	return true
+}
+
+func (c *Chat) releaseName(u *chatter) {
+	if c.names[u.name] == u {
+		delete(c.names, u.name)
+		for other := range c.Users {
+			if other != u && other.name == u.name {
+				c.names[other.name] = other
+				break
+			}
+		}
+	}
+}
+
+func (c *Chat) Connect(ws *websocket.Conn, auth *UserData, owner bool) (*chatter, error) {
+	chatter := &chatter{socket: ws, chat: c, owner: owner}
 	if auth != nil {
+		c.banLock.Lock()
+		_, banned := c.banned[auth.Login]
+		c.banLock.Unlock()
+		if !banned && c.db != nil {
+			// The ban may have been issued while the stream was offline, before
+			// this chat existed.
+			var err error
+			if banned, err = c.db.IsChatBanned(c.id, auth.Login); err != nil {
+				return nil, err
+			}
+		}
+		if banned {
+			return nil, errChatBanned
+		}
 		chatter.name = auth.Name
 		chatter.login = auth.Login
-		chatter.pushName()
 	}
-	c.events <- chatter
-	return chatter
+	reply := make(chan error, 1)
+	c.events <- chatJoinEvent{chatter, reply}
+	if err := <-reply; err != nil {
+		return nil, err
+	}
+	return chatter, nil
 }
 
 func (c *Chat) Disconnect(u *chatter) {
-	c.events <- u
+	c.events <- chatLeaveEvent{u}
 }
 
 func (c *Chat) Close() {
-	c.events <- nil
+	c.send(nil)
+}
+
+// Change how many messages are kept in `History` (and replayed to new users).
+func (c *Chat) SetHistorySize(size int) {
+	if size < 0 {
+		size = 0
+	}
+	c.send(chatHistorySizeEvent{size})
+}
+
+// Tell everyone the stream has ended.
+func (c *Chat) NewStreamOffline() {
+	c.send(chatOfflineEvent{})
+}
+
+// Stop messages containing any of these words or phrases (case-insensitive) from
+// being sent. If `censor` is set, the words are replaced with asterisks instead.
+func (c *Chat) SetBlockedWords(words []string, censor bool) {
+	var filter *regexp.Regexp
+	quoted := []string{}
+	for _, word := range words {
+		if word = strings.TrimSpace(word); word != "" {
+			quoted = append(quoted, regexp.QuoteMeta(word))
+		}
+	}
+	if len(quoted) != 0 {
+		filter = regexp.MustCompile("(?i)" + strings.Join(quoted, "|"))
+	}
+	c.filterLock.Lock()
+	c.filter, c.censor = filter, censor
+	c.filterLock.Unlock()
 }
 
-func (chat *Chat) RunRPC(ws *websocket.Conn, user *UserData) {
-	chatter := chat.Connect(ws, user)
+// Apply the filter set by `SetBlockedWords`. Only whole words count: blocking "ass"
+// should not affect "class". (`\b` is not used because it only knows ASCII.)
+func (c *Chat) filterMessage(text string) (string, error) {
+	c.filterLock.Lock()
+	filter, censor := c.filter, c.censor
+	c.filterLock.Unlock()
+	if filter == nil {
+		return text, nil
+	}
+	isWordRune := func(r rune) bool {
+		return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+	}
+	result, last := "", 0
+	for _, m := range filter.FindAllStringIndex(text, -1) {
+		before, _ := utf8.DecodeLastRuneInString(text[:m[0]])
+		after, _ := utf8.DecodeRuneInString(text[m[1]:])
+		if (m[0] != 0 && isWordRune(before)) || (m[1] != len(text) && isWordRune(after)) {
+			continue
+		}
+		if !censor {
+			return "", errChatBlocked
+		}
+		result += text[last:m[0]] + strings.Map(func(r rune) rune {
+			if unicode.IsSpace(r) {
+				return r
+			}
+			return '*'
+		}, text[m[0]:m[1]])
+		last = m[1]
+	}
+	return result + text[last:], nil
+}
+
+var emoteCode = regexp.MustCompile(`:[^:\s]+:`)
+
+// The number of characters in a message, counting each emote as one.
+func (c *Chat) messageLength(text string) int {
+	n := utf8.RuneCountInString(text)
+	if len(c.Emotes) != 0 {
+		for _, code := range emoteCode.FindAllString(text, -1) {
+			if _, ok := c.Emotes[code[1:len(code)-1]]; ok {
+				n -= utf8.RuneCountInString(code) - 1
+			}
+		}
+	}
+	return n
+}
+
+// Pass an event to `handle`, unless the chat has already been closed.
+func (c *Chat) send(event interface{}) {
+	select {
+	case c.events <- event:
+	case <-c.done:
+	}
+}
+
+func (chat *Chat) RunRPC(ws *websocket.Conn, user *UserData, owner bool) {
+	chatter, err := chat.Connect(ws, user, owner)
+	if err == errChatFull {
+		RPCPushEvent(ws, "Chat.Full")
+		return
+	}
+	if err != nil {
+		RPCPushEvent(ws, "Chat.Banned")
+		return
+	}
 	defer chat.Disconnect(chatter)
 	RPCPushEvent(ws, "RPC.Loaded", true)
+	if len(chat.Emotes) != 0 {
+		RPCPushEvent(ws, "Chat.Emotes", chat.Emotes)
+	}
 	chat.History.Iterate(chatter.pushMessage)
 	server := rpc.NewServer()
 	server.RegisterName("Chat", chatter)
 	server.ServeCodec(jsonrpc2.NewServerCodec(ws, server))
 }
 
+type RPCNoArgs struct{}
+
 type RPCSingleStringArg struct {
 	First string
 }
 
-func (x *RPCSingleStringArg) UnmarshalJSON(buf []byte) error {
-	fields := []interface{}{&x.First}
+type RPCSingleIntArg struct {
+	First int64
+}
+
+type RPCSingleBoolArg struct {
+	First bool
+}
+
+type RPCTwoStringArgs struct {
+	First  string
+	Second string
+}
+
+// Decode positional parameters (a JSON array) into the given pointers.
+func RPCUnmarshalArgs(buf []byte, fields ...interface{}) error {
 	expect := len(fields)
 	if err := json.Unmarshal(buf, &fields); err != nil {
 		return err
@@ -143,6 +693,26 @@ func (x *RPCSingleStringArg) UnmarshalJSON(buf []byte) error {
 	return nil
 }
 
+func (x *RPCNoArgs) UnmarshalJSON(buf []byte) error {
+	return RPCUnmarshalArgs(buf)
+}
+
+func (x *RPCSingleStringArg) UnmarshalJSON(buf []byte) error {
+	return RPCUnmarshalArgs(buf, &x.First)
+}
+
+func (x *RPCSingleIntArg) UnmarshalJSON(buf []byte) error {
+	return RPCUnmarshalArgs(buf, &x.First)
+}
+
+func (x *RPCSingleBoolArg) UnmarshalJSON(buf []byte) error {
+	return RPCUnmarshalArgs(buf, &x.First)
+}
+
+func (x *RPCTwoStringArgs) UnmarshalJSON(buf []byte) error {
+	return RPCUnmarshalArgs(buf, &x.First, &x.Second)
+}
+
 func RPCPushEvent(ws *websocket.Conn, name string, args ...interface{}) error {
 	return websocket.JSON.Send(ws, map[string]interface{}{
 		"jsonrpc": "2.0", "method": name, "params": args,
@@ -154,29 +724,263 @@ func (ctx *chatter) SetName(args *RPCSingleStringArg, _ *interface{}) error {
 	if err := ValidateUsername(name); err != nil {
 		return err
 	}
-	ctx.name = name
-	ctx.pushName()
-	return nil
+	if ctx.login == "" && ctx.chat.db != nil {
+		// registered users should not find someone else using their name.
+		if taken, err := ctx.chat.db.IsNameRegistered(name); err != nil {
+			return err
+		} else if taken {
+			return errChatNameReserved
+		}
+	}
+	reply := make(chan error)
+	ctx.chat.events <- chatSetNameEvent{ctx, name, reply}
+	return <-reply
 }
 
 func (ctx *chatter) SendMessage(args *RPCSingleStringArg, _ *interface{}) error {
-	if ctx.name == "" {
-		return errors.New("must obtain a name first")
+	name := ctx.currentName()
+	if name == "" {
+		return errChatNoName
+	}
+	msg := ChatMessage{name: name, login: ctx.login, text: cleanChatMessage(args.First)}
+	if strings.HasPrefix(msg.text, "/me ") {
+		msg.text, msg.action = strings.TrimSpace(msg.text[4:]), true
+	}
+	if n := ctx.chat.messageLength(msg.text); n == 0 || n > 256 {
+		return errChatLength
 	}
-	msg := ChatMessage{ctx.name, ctx.login, strings.TrimSpace(args.First)}
-	if len(msg.text) == 0 || len(msg.text) > 256 {
-		return errors.New("message must have between 1 and 256 characters")
+	text, err := ctx.chat.filterMessage(msg.text)
+	if err != nil {
+		return err
+	}
+	msg.text = text
+	now := time.Now()
+	if err := ctx.takeRateToken(now); err != nil {
+		return err
 	}
+	ctx.touch(now)
 	ctx.chat.events <- msg
 	return nil
 }
 
+// Send a message only to the user with a given name. It is not saved in the history.
+func (ctx *chatter) Whisper(args *RPCTwoStringArgs, _ *interface{}) error {
+	if ctx.currentName() == "" {
+		return errChatNoName
+	}
+	text := cleanChatMessage(args.Second)
+	if n := ctx.chat.messageLength(text); n == 0 || n > 256 {
+		return errChatLength
+	}
+	text, err := ctx.chat.filterMessage(text)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if err := ctx.takeRateToken(now); err != nil {
+		return err
+	}
+	ctx.touch(now)
+	reply := make(chan error)
+	ctx.chat.events <- chatWhisperEvent{ctx, strings.TrimSpace(args.First), text, reply}
+	return <-reply
+}
+
+func (ctx *chatter) RequestUserList(_ *RPCNoArgs, _ *interface{}) error {
+	ctx.chat.events <- chatUserListEvent{ctx}
+	return nil
+}
+
+// Tell others that this user is (or is no longer) writing a message.
+func (ctx *chatter) SetTyping(args *RPCSingleBoolArg, _ *interface{}) error {
+	if ctx.currentName() == "" {
+		return errChatNoName
+	}
+	ctx.chat.events <- chatTypingEvent{ctx, args.First}
+	return nil
+}
+
+func (ctx *chatter) currentName() string {
+	ctx.nameLock.Lock()
+	defer ctx.nameLock.Unlock()
+	return ctx.name
+}
+
+func (ctx *chatter) setName(name string) {
+	ctx.nameLock.Lock()
+	ctx.name = name
+	ctx.nameLock.Unlock()
+}
+
+// Remember that the user is still around (see `Chat.NameExpiry`).
+func (ctx *chatter) touch(now time.Time) {
+	atomic.StoreInt64(&ctx.active, now.UnixNano())
+}
+
+func (ctx *chatter) lastActive() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&ctx.active))
+}
+
+// Remove control characters (including newlines) and surrounding whitespace.
+func cleanChatMessage(text string) string {
+	return strings.TrimSpace(strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, text))
+}
+
+// Check whether the user may send a message now (and if so, assume they did.)
+func (ctx *chatter) takeRateToken(now time.Time) error {
+	ctx.rateLock.Lock()
+	defer ctx.rateLock.Unlock()
+	slow := time.Duration(atomic.LoadInt64(&ctx.chat.slowMode)) * time.Second
+	if slow != 0 && !ctx.owner && now.Sub(ctx.lastSent) < slow {
+		return errChatSlowMode
+	}
+	if limit := float64(ctx.chat.RateLimit); limit > 0 {
+		tokens := limit
+		if !ctx.lastSent.IsZero() {
+			if tokens = ctx.rateTokens + now.Sub(ctx.lastSent).Seconds()*limit/10; tokens > limit {
+				tokens = limit
+			}
+		}
+		if tokens < 1 {
+			return errChatRateLimit
+		}
+		ctx.rateTokens = tokens - 1
+	}
+	ctx.lastSent = now
+	return nil
+}
+
+// Require everyone but the streamer to wait this many seconds between messages.
+// 0 turns this off.
+func (ctx *chatter) SetSlowMode(args *RPCSingleIntArg, _ *interface{}) error {
+	if !ctx.owner {
+		return errChatOwnerOnly
+	}
+	if args.First < 0 {
+		return errors.New("invalid interval")
+	}
+	atomic.StoreInt64(&ctx.chat.slowMode, args.First)
+	ctx.chat.events <- chatSlowModeEvent{args.First}
+	return nil
+}
+
+// Remove a message (by the ID from `Chat.Message`) from the history.
+func (ctx *chatter) DeleteMessage(args *RPCSingleIntArg, _ *interface{}) error {
+	if !ctx.owner {
+		return errChatOwnerOnly
+	}
+	ctx.chat.events <- chatDeleteEvent{args.First}
+	return nil
+}
+
+// Disconnect a logged-in user. They can rejoin immediately, though.
+func (ctx *chatter) Kick(args *RPCSingleStringArg, _ *interface{}) error {
+	if !ctx.owner {
+		return errChatOwnerOnly
+	}
+	if args.First == "" {
+		return errors.New("only logged-in users can be kicked")
+	}
+	ctx.chat.events <- chatKickEvent{args.First, false}
+	return nil
+}
+
+// Disconnect a logged-in user and prevent them from rejoining. The user does not
+// have to be online at the moment.
+func (ctx *chatter) Ban(args *RPCSingleStringArg, _ *interface{}) error {
+	if !ctx.owner {
+		return errChatOwnerOnly
+	}
+	if args.First == "" {
+		return errChatAnonymous
+	}
+	ctx.chat.banLock.Lock()
+	ctx.chat.banned[args.First] = struct{}{}
+	ctx.chat.banLock.Unlock()
+	if db := ctx.chat.db; db != nil {
+		ctx.chat.save(func() {
+			if err := db.BanChatUser(ctx.chat.id, args.First); err != nil {
+				log.Println("Error saving a chat ban: ", err)
+			}
+		})
+	}
+	ctx.chat.events <- chatKickEvent{args.First, true}
+	return nil
+}
+
+// Allow a banned user to join again.
+func (ctx *chatter) Unban(args *RPCSingleStringArg, _ *interface{}) error {
+	if !ctx.owner {
+		return errChatOwnerOnly
+	}
+	ctx.chat.banLock.Lock()
+	delete(ctx.chat.banned, args.First)
+	ctx.chat.banLock.Unlock()
+	if db := ctx.chat.db; db != nil {
+		ctx.chat.save(func() {
+			if err := db.UnbanChatUser(ctx.chat.id, args.First); err != nil {
+				log.Println("Error removing a chat ban: ", err)
+			}
+		})
+	}
+	return nil
+}
+
 func (ctx *chatter) pushName() error {
 	return RPCPushEvent(ctx.socket, "Chat.AcquiredName", ctx.name, ctx.login)
 }
 
 func (ctx *chatter) pushMessage(msg ChatMessage) error {
-	return RPCPushEvent(ctx.socket, "Chat.Message", msg.name, msg.text, msg.login)
+	return RPCPushEvent(ctx.socket, "Chat.Message", msg.name, msg.text, msg.login, msg.action, msg.id,
+		msg.time.UnixNano()/int64(time.Millisecond))
+}
+
+func (ctx *chatter) pushWhisper(from *chatter, to string, text string) error {
+	return RPCPushEvent(ctx.socket, "Chat.Whisper", from.name, from.login, to, text)
+}
+
+func (ctx *chatter) pushPresence(u *chatter, joined bool) error {
+	if joined {
+		return RPCPushEvent(ctx.socket, "Chat.UserJoined", u.name, u.login)
+	}
+	return RPCPushEvent(ctx.socket, "Chat.UserLeft", u.name, u.login)
+}
+
+func (ctx *chatter) pushOffline() error {
+	return RPCPushEvent(ctx.socket, "Stream.Offline")
+}
+
+func (ctx *chatter) pushSlowMode(seconds int64) error {
+	return RPCPushEvent(ctx.socket, "Chat.SlowMode", seconds)
+}
+
+func (ctx *chatter) pushNameTaken(name string) error {
+	return RPCPushEvent(ctx.socket, "Chat.NameTaken", name)
+}
+
+func (ctx *chatter) pushNameExpired(name string) error {
+	return RPCPushEvent(ctx.socket, "Chat.NameExpired", name)
+}
+
+func (ctx *chatter) pushUserList(users [][]string) error {
+	return RPCPushEvent(ctx.socket, "Chat.UserList", users)
+}
+
+func (ctx *chatter) pushTyping(u *chatter, typing bool) error {
+	return RPCPushEvent(ctx.socket, "Chat.Typing", u.name, u.login, typing)
+}
+
+func (ctx *chatter) pushDeletion(id int64) error {
+	return RPCPushEvent(ctx.socket, "Chat.MessageDeleted", id)
+}
+
+func (ctx *chatter) pushBan(login string) error {
+	return RPCPushEvent(ctx.socket, "Chat.UserBanned", login)
 }
 
 func (ctx *chatter) pushViewerCount() error {
@@ -0,0 +1,719 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/powerman/rpc-codec/jsonrpc2"
+	"golang.org/x/net/websocket"
+)
+
+// The server side of a websocket connection, for `Chat.Connect`, and the client side.
+func testSocket(t *testing.T) (*websocket.Conn, *websocket.Conn) {
+	accepted := make(chan *websocket.Conn)
+	done := make(chan struct{})
+	s := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		accepted <- ws
+		<-done
+	}))
+	t.Cleanup(func() {
+		close(done)
+		s.Close()
+	})
+	client, err := websocket.Dial("ws"+s.URL[len("http"):], "", "http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return <-accepted, client
+}
+
+// The names of the RPC events pushed to a client, until none arrive for a while.
+func testEvents(ws *websocket.Conn) []string {
+	var events []string
+	for {
+		var event struct{ Method string }
+		ws.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		if websocket.JSON.Receive(ws, &event) != nil {
+			return events
+		}
+		events = append(events, event.Method)
+	}
+}
+
+func hasEvent(events []string, method string) bool {
+	for _, e := range events {
+		if e == method {
+			return true
+		}
+	}
+	return false
+}
+
+func TestChatNames(t *testing.T) {
+	db := testDB(t)
+	user, err := db.NewUser("bob", "bob@example.com", []byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.SetUserData(user.ID, "Bobby", "", "", "", nil, ""); err != nil {
+		t.Fatal(err)
+	}
+	chat := NewChat(10, "test", db)
+	defer chat.Close()
+	srvA, a := testSocket(t)
+	anon, err := chat.Connect(srvA, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the name shown in chat is reserved, not the login.
+	if err := anon.SetName(&RPCSingleStringArg{"Bobby"}, nil); err != errChatNameReserved {
+		t.Fatal(err)
+	}
+	if err := anon.SetName(&RPCSingleStringArg{"bob"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	// Someone else could still be using the name of a user who wasn't registered yet.
+	if err := anon.SetName(&RPCSingleStringArg{"Robert"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	srvB, _ := testSocket(t)
+	other, err := chat.Connect(srvB, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.SetName(&RPCSingleStringArg{"Robert"}, nil); err != errChatNameTaken {
+		t.Fatal(err)
+	}
+	testEvents(a)
+	srvC, c := testSocket(t)
+	if _, err := chat.Connect(srvC, &UserData{Login: "rob", Name: "Robert"}, false); err != nil {
+		t.Fatal(err)
+	}
+	if events := testEvents(a); !hasEvent(events, "Chat.NameTaken") || anon.currentName() != "" {
+		t.Fatal("the anonymous user kept the name: ", events)
+	}
+	if events := testEvents(c); !hasEvent(events, "Chat.AcquiredName") {
+		t.Fatal("the registered user did not get the name: ", events)
+	}
+}
+
+func TestChatWhisper(t *testing.T) {
+	chat := NewChat(10, "test", nil)
+	defer chat.Close()
+	var users []*chatter
+	var clients []*websocket.Conn
+	for _, name := range []string{"alice", "bob", "carol"} {
+		srv, client := testSocket(t)
+		u, err := chat.Connect(srv, &UserData{Login: name, Name: name}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		users, clients = append(users, u), append(clients, client)
+	}
+	for _, c := range clients {
+		testEvents(c)
+	}
+	if err := users[0].Whisper(&RPCTwoStringArgs{"dave", "hi"}, nil); err != errChatNoSuchUser {
+		t.Fatal(err)
+	}
+	if err := users[0].Whisper(&RPCTwoStringArgs{"bob", "hi"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	// The sender gets an echo, the recipient gets the message, and nobody else does.
+	for i, expect := range []bool{true, true, false} {
+		if events := testEvents(clients[i]); hasEvent(events, "Chat.Whisper") != expect {
+			t.Fatal(i, events)
+		}
+	}
+}
+
+func TestChatBanAnonymous(t *testing.T) {
+	chat := NewChat(10, "test", nil)
+	defer chat.Close()
+	srv, _ := testSocket(t)
+	owner, err := chat.Connect(srv, &UserData{Login: "test", Name: "test"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Anonymous users have no login to ban.
+	if err := owner.Ban(&RPCSingleStringArg{""}, nil); err != errChatAnonymous {
+		t.Fatal(err)
+	}
+}
+
+// Bans are written in the background; wait until one is (or isn't) visible.
+func waitChatBanned(t *testing.T, db Database, login string, banned bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		ok, err := db.IsChatBanned("test", login)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok == banned {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: expected banned = %v", login, banned)
+		}
+	}
+}
+
+func TestChatBanPersistent(t *testing.T) {
+	db := testDB(t)
+	if _, err := db.NewUser("test", "test@example.com", []byte("password")); err != nil {
+		t.Fatal(err)
+	}
+	chat := NewChat(10, "test", db)
+	srv, _ := testSocket(t)
+	owner, err := chat.Connect(srv, &UserData{Login: "test", Name: "test"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := owner.Ban(&RPCSingleStringArg{"troll"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	chat.Close()
+	waitChatBanned(t, db, "troll", true)
+
+	chat = NewChat(10, "test", db)
+	defer chat.Close()
+	srv, _ = testSocket(t)
+	if _, err := chat.Connect(srv, &UserData{Login: "troll", Name: "troll"}, false); err != errChatBanned {
+		t.Fatal(err)
+	}
+	srv, _ = testSocket(t)
+	owner, err = chat.Connect(srv, &UserData{Login: "test", Name: "test"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := owner.Unban(&RPCSingleStringArg{"troll"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	waitChatBanned(t, db, "troll", false)
+	srv, _ = testSocket(t)
+	if _, err := chat.Connect(srv, &UserData{Login: "troll", Name: "troll"}, false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChatRateLimit(t *testing.T) {
+	chat := NewChat(10, "test", nil)
+	chat.RateLimit = 3
+	defer chat.Close()
+	srv, _ := testSocket(t)
+	u, err := chat.Connect(srv, &UserData{Login: "test", Name: "test"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := u.SendMessage(&RPCSingleStringArg{"hi"}, nil); err != nil {
+			t.Fatal(i, err)
+		}
+	}
+	if err := u.SendMessage(&RPCSingleStringArg{"hi"}, nil); err != errChatRateLimit {
+		t.Fatal(err)
+	}
+	// 3 messages per 10 seconds means a new one every 3.3 seconds.
+	now := time.Now()
+	if err := u.takeRateToken(now.Add(time.Second)); err != errChatRateLimit {
+		t.Fatal(err)
+	}
+	if err := u.takeRateToken(now.Add(4 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.takeRateToken(now.Add(5 * time.Second)); err != errChatRateLimit {
+		t.Fatal(err)
+	}
+	// The bucket is refilled, but not beyond its size.
+	for i := 0; i < 3; i++ {
+		if err := u.takeRateToken(now.Add(time.Minute)); err != nil {
+			t.Fatal(i, err)
+		}
+	}
+	if err := u.takeRateToken(now.Add(time.Minute)); err != errChatRateLimit {
+		t.Fatal(err)
+	}
+}
+
+func TestChatMessageLength(t *testing.T) {
+	u := &chatter{name: "test", chat: &Chat{events: make(chan interface{}, 1)}}
+	for _, c := range []struct {
+		text string
+		sent string // Empty if rejected.
+	}{
+		{strings.Repeat("😀", 256), strings.Repeat("😀", 256)},
+		{strings.Repeat("😀", 257), ""},
+		{strings.Repeat("漢", 256), strings.Repeat("漢", 256)},
+		{strings.Repeat("漢", 257), ""},
+		// Only what remains after cleaning up counts.
+		{" \t" + strings.Repeat("漢", 256) + "\n", strings.Repeat("漢", 256)},
+		{"a\x00b\x1bc\u0085", "abc"},
+		{" \t\n　", ""},
+		{"\x00\x7f", ""},
+	} {
+		err := u.SendMessage(&RPCSingleStringArg{c.text}, nil)
+		if c.sent == "" {
+			if err != errChatLength {
+				t.Fatalf("%q: %v", c.text, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: %v", c.text, err)
+		}
+		if msg := (<-u.chat.events).(ChatMessage); msg.text != c.sent {
+			t.Fatalf("%q: sent %q", c.text, msg.text)
+		}
+	}
+}
+
+func TestChatAction(t *testing.T) {
+	u := &chatter{name: "test", chat: &Chat{events: make(chan interface{}, 1)}}
+	for _, c := range []struct {
+		text   string
+		sent   string
+		action bool
+	}{
+		{"/me hi", "hi", true},
+		{"/me   waves  ", "waves", true},
+		{"/mehi", "/mehi", false},
+		{"hi /me", "hi /me", false},
+	} {
+		if err := u.SendMessage(&RPCSingleStringArg{c.text}, nil); err != nil {
+			t.Fatalf("%q: %v", c.text, err)
+		}
+		if msg := (<-u.chat.events).(ChatMessage); msg.text != c.sent || msg.action != c.action {
+			t.Fatalf("%q: sent %q, action = %v", c.text, msg.text, msg.action)
+		}
+	}
+	// The flag goes after the parameters that older clients know about.
+	srv, client := testSocket(t)
+	u.socket = srv
+	if err := u.pushMessage(ChatMessage{name: "test", text: "hi", action: true}); err != nil {
+		t.Fatal(err)
+	}
+	var event struct {
+		Method string
+		Params []interface{}
+	}
+	if err := websocket.JSON.Receive(client, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Method != "Chat.Message" || len(event.Params) < 4 || event.Params[1] != "hi" || event.Params[3] != true {
+		t.Fatal(event)
+	}
+}
+
+func TestChatUserList(t *testing.T) {
+	chat := NewChat(10, "test", nil)
+	defer chat.Close()
+	var users []*chatter
+	var client *websocket.Conn
+	for _, data := range []*UserData{{Login: "alice", Name: "alice"}, {Login: "bob", Name: "Bob"}, nil, nil} {
+		srv, c := testSocket(t)
+		u, err := chat.Connect(srv, data, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if client == nil {
+			client = c
+		}
+		users = append(users, u)
+	}
+	// Anonymous users without a name are not listed.
+	if err := users[2].SetName(&RPCSingleStringArg{"carol"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	testEvents(client)
+	if err := users[0].RequestUserList(&RPCNoArgs{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	var event struct {
+		Method string
+		Params [][][]string
+	}
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if err := websocket.JSON.Receive(client, &event); err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	if event.Method == "Chat.UserList" && len(event.Params) == 1 {
+		for _, u := range event.Params[0] {
+			got[u[0]] = u[1]
+		}
+	}
+	if len(got) != 3 || got["alice"] != "alice" || got["Bob"] != "bob" || got["carol"] != "" {
+		t.Fatal(event)
+	}
+}
+
+func TestChatSlowMode(t *testing.T) {
+	chat := NewChat(10, "test", nil)
+	defer chat.Close()
+	srvA, _ := testSocket(t)
+	owner, err := chat.Connect(srvA, &UserData{Login: "test", Name: "test"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvB, b := testSocket(t)
+	u, err := chat.Connect(srvB, &UserData{Login: "bob", Name: "bob"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testEvents(b)
+	if err := u.SetSlowMode(&RPCSingleIntArg{5}, nil); err != errChatOwnerOnly {
+		t.Fatal(err)
+	}
+	if err := owner.SetSlowMode(&RPCSingleIntArg{5}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if events := testEvents(b); !hasEvent(events, "Chat.SlowMode") {
+		t.Fatal(events)
+	}
+	if err := u.SendMessage(&RPCSingleStringArg{"hi"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.SendMessage(&RPCSingleStringArg{"hi"}, nil); err != errChatSlowMode {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if err := u.takeRateToken(now.Add(4 * time.Second)); err != errChatSlowMode {
+		t.Fatal(err)
+	}
+	if err := u.takeRateToken(now.Add(6 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	// The streamer is not limited.
+	for i := 0; i < 2; i++ {
+		if err := owner.SendMessage(&RPCSingleStringArg{"hi"}, nil); err != nil {
+			t.Fatal(i, err)
+		}
+	}
+	if err := owner.SetSlowMode(&RPCSingleIntArg{0}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.SendMessage(&RPCSingleStringArg{"hi"}, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChatMaxUsers(t *testing.T) {
+	chat := NewChat(10, "test", nil)
+	chat.MaxUsers = 2
+	defer chat.Close()
+	var first *chatter
+	for i := 0; i < 2; i++ {
+		srv, _ := testSocket(t)
+		u, err := chat.Connect(srv, nil, false)
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		if first == nil {
+			first = u
+		}
+	}
+	srv, client := testSocket(t)
+	go chat.RunRPC(srv, nil, false)
+	if events := testEvents(client); len(events) != 1 || events[0] != "Chat.Full" {
+		t.Fatal(events)
+	}
+	srv, _ = testSocket(t)
+	if _, err := chat.Connect(srv, &UserData{Login: "bob", Name: "bob"}, false); err != errChatFull {
+		t.Fatal(err)
+	}
+	chat.AdmitLoggedIn = true
+	if _, err := chat.Connect(srv, &UserData{Login: "bob", Name: "bob"}, false); err != nil {
+		t.Fatal(err)
+	}
+	srv, _ = testSocket(t)
+	if _, err := chat.Connect(srv, &UserData{Login: "test", Name: "test"}, true); err != nil {
+		t.Fatal(err)
+	}
+	// There are still 3 users, which is over the limit.
+	chat.Disconnect(first)
+	srv, _ = testSocket(t)
+	if _, err := chat.Connect(srv, nil, false); err != errChatFull {
+		t.Fatal(err)
+	}
+}
+
+func TestChatBlockedWords(t *testing.T) {
+	u := &chatter{name: "test", chat: &Chat{events: make(chan interface{}, 1)}}
+	u.chat.SetBlockedWords([]string{"ass", "Бля", " ", "two words"}, false)
+	for _, c := range []struct {
+		text    string
+		allowed bool
+	}{
+		{"class", true},
+		{"ASS", false},
+		{"an ass.", false},
+		{"бля!", false},
+		{"two  words", true},
+		{"TWO WORDS x", false},
+	} {
+		err := u.SendMessage(&RPCSingleStringArg{c.text}, nil)
+		if c.allowed && err == nil {
+			<-u.chat.events
+		} else if c.allowed || err != errChatBlocked {
+			t.Fatalf("%q: %v", c.text, err)
+		}
+	}
+	u.chat.SetBlockedWords([]string{"ass", "бля", "two words"}, true)
+	for _, c := range []struct{ text, sent string }{
+		{"a ass b", "a *** b"},
+		{"class", "class"},
+		{"бля, two words", "***, *** *****"},
+	} {
+		if err := u.SendMessage(&RPCSingleStringArg{c.text}, nil); err != nil {
+			t.Fatalf("%q: %v", c.text, err)
+		}
+		if msg := (<-u.chat.events).(ChatMessage); msg.text != c.sent {
+			t.Fatalf("%q: sent %q", c.text, msg.text)
+		}
+	}
+}
+
+func TestChatHistorySize(t *testing.T) {
+	ids := func(q *ChatMessageQueue) (r []int64) {
+		q.Iterate(func(m ChatMessage) error {
+			r = append(r, m.id)
+			return nil
+		})
+		return
+	}
+	q := ChatMessageQueue{make([]ChatMessage, 0, 5), 0}
+	for i := int64(1); i <= 7; i++ {
+		q.Push(ChatMessage{id: i})
+	}
+	q.Resize(3)
+	if r := ids(&q); !reflect.DeepEqual(r, []int64{5, 6, 7}) {
+		t.Fatal(r)
+	}
+	q.Resize(6)
+	for i := int64(8); i <= 11; i++ {
+		q.Push(ChatMessage{id: i})
+	}
+	if r := ids(&q); !reflect.DeepEqual(r, []int64{6, 7, 8, 9, 10, 11}) {
+		t.Fatal(r)
+	}
+	q.Resize(0)
+	q.Push(ChatMessage{id: 12})
+	if r := ids(&q); len(r) != 0 {
+		t.Fatal(r)
+	}
+	// The same thing from the outside, where the resize happens in between messages.
+	chat := NewChat(5, "test", nil)
+	for i := 0; i < 7; i++ {
+		chat.events <- ChatMessage{text: "hi"}
+	}
+	chat.SetHistorySize(3)
+	chat.SetHistorySize(6)
+	for i := 0; i < 4; i++ {
+		chat.events <- ChatMessage{text: "hi"}
+	}
+	chat.Close()
+	<-chat.done
+	if r := ids(&chat.History); !reflect.DeepEqual(r, []int64{6, 7, 8, 9, 10, 11}) {
+		t.Fatal(r)
+	}
+}
+
+func TestChatTimestamps(t *testing.T) {
+	chat := NewChat(10, "test", nil)
+	defer chat.Close()
+	srv, _ := testSocket(t)
+	u, err := chat.Connect(srv, &UserData{Login: "test", Name: "test"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now().UnixNano() / int64(time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if err := u.SendMessage(&RPCSingleStringArg{"hi"}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The history is replayed with the original times.
+	srv, client := testSocket(t)
+	go chat.RunRPC(srv, nil, false)
+	var times []int64
+	for {
+		var event struct {
+			Method string
+			Params []interface{}
+		}
+		client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		if websocket.JSON.Receive(client, &event) != nil {
+			break
+		}
+		if event.Method == "Chat.Message" {
+			// The time is the last parameter, in milliseconds since the Unix epoch.
+			ms, _ := event.Params[len(event.Params)-1].(float64)
+			times = append(times, int64(ms))
+		}
+	}
+	if len(times) != 3 {
+		t.Fatal(times)
+	}
+	// (Messages are only timestamped once `handle` gets them, not by `SendMessage`.)
+	end := time.Now().UnixNano() / int64(time.Millisecond)
+	for i, ms := range times {
+		if ms < start || ms > end || (i != 0 && ms < times[i-1]) {
+			t.Fatal(start, times, end)
+		}
+	}
+}
+
+func TestChatNameExpiry(t *testing.T) {
+	chat := NewChat(10, "test", nil)
+	chat.NameExpiry = time.Minute
+	defer chat.Close()
+	srvA, a := testSocket(t)
+	anon, err := chat.Connect(srvA, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvB, _ := testSocket(t)
+	bob, err := chat.Connect(srvB, &UserData{Login: "bob", Name: "bob"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = anon.SetName(&RPCSingleStringArg{"anon"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	testEvents(a)
+	start := time.Now()
+	chat.events <- chatTickEvent{start.Add(30 * time.Second)}
+	if events := testEvents(a); hasEvent(events, "Chat.NameExpired") || anon.currentName() != "anon" {
+		t.Fatal("expired too early: ", events)
+	}
+	chat.events <- chatTickEvent{start.Add(2 * time.Minute)}
+	if events := testEvents(a); !hasEvent(events, "Chat.NameExpired") || anon.currentName() != "" {
+		t.Fatal("not expired: ", events)
+	}
+	// Logged-in users keep theirs.
+	if bob.currentName() != "bob" {
+		t.Fatal(bob.currentName())
+	}
+	if err = anon.SendMessage(&RPCSingleStringArg{"hi"}, nil); err != errChatNoName {
+		t.Fatal(err)
+	}
+	// The name is free to take again.
+	srvC, _ := testSocket(t)
+	other, err := chat.Connect(srvC, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = other.SetName(&RPCSingleStringArg{"anon"}, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChatViewerCount(t *testing.T) {
+	chat := NewChat(10, "test", nil)
+	defer chat.Close()
+	srv, client := testSocket(t)
+	if _, err := chat.Connect(srv, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 30; i++ {
+		srv, _ := testSocket(t)
+		if _, err := chat.Connect(srv, nil, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		chat.events <- chatTickEvent{time.Now()}
+	}
+	var counts []float64
+	for {
+		var event struct {
+			Method string
+			Params []float64
+		}
+		client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		if websocket.JSON.Receive(client, &event) != nil {
+			break
+		}
+		if event.Method == "Stream.ViewerCount" {
+			counts = append(counts, event.Params[0])
+		}
+	}
+	// Each user gets the count upon joining; updates are only sent on ticks, and only
+	// if it has changed since the last one.
+	if len(counts) != 2 || counts[0] != 1 || counts[1] != 31 {
+		t.Fatal(counts)
+	}
+}
+
+func TestChatErrorCodes(t *testing.T) {
+	chat := NewChat(10, "test", nil)
+	defer chat.Close()
+	srv, _ := testSocket(t)
+	u, err := chat.Connect(srv, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range []struct {
+		call func() error
+		code int // 0 if it should succeed.
+	}{
+		{func() error { return u.SendMessage(&RPCSingleStringArg{"hi"}, nil) }, ChatErrorNoName},
+		{func() error { return u.SetName(&RPCSingleStringArg{"test"}, nil) }, 0},
+		{func() error { return u.SendMessage(&RPCSingleStringArg{strings.Repeat("a", 257)}, nil) }, ChatErrorLength},
+		{func() error { return u.SendMessage(&RPCSingleStringArg{" "}, nil) }, ChatErrorLength},
+		{func() error { return u.SetSlowMode(&RPCSingleIntArg{5}, nil) }, ChatErrorOwnerOnly},
+		{func() error { return u.Whisper(&RPCTwoStringArgs{"nobody", "hi"}, nil) }, ChatErrorNoSuchUser},
+		{func() error { return u.SendMessage(&RPCSingleStringArg{"hi"}, nil) }, 0},
+	} {
+		// The codec sends the code of a `*jsonrpc2.Error` as is.
+		var e *jsonrpc2.Error
+		err := c.call()
+		if (c.code == 0 && err != nil) || (c.code != 0 && (!errors.As(err, &e) || e.Code != c.code)) {
+			t.Fatalf("%d: expected code %d, got %v", i, c.code, err)
+		}
+	}
+}
+
+func TestChatEmotes(t *testing.T) {
+	chat := NewChat(10, "test", nil)
+	chat.Emotes = map[string]string{"kappa": "/static/kappa.png"}
+	defer chat.Close()
+	srv, client := testSocket(t)
+	go chat.RunRPC(srv, nil, false)
+	var emotes map[string]string
+	for {
+		var event struct {
+			Method string
+			Params []json.RawMessage
+		}
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		if err := websocket.JSON.Receive(client, &event); err != nil {
+			t.Fatal("no emotes: ", err)
+		}
+		if event.Method == "Chat.Emotes" {
+			if err := json.Unmarshal(event.Params[0], &emotes); err != nil {
+				t.Fatal(err)
+			}
+			break
+		}
+	}
+	if !reflect.DeepEqual(emotes, chat.Emotes) {
+		t.Fatal(emotes)
+	}
+	// Each emote counts as a single character; unknown ones as they are.
+	for text, n := range map[string]int{
+		strings.Repeat(":kappa:", 200): 200,
+		":kappa::kappa: hi":            5,
+		":nope: x":                     8,
+		"::kappa: :":                   4,
+	} {
+		if got := chat.messageLength(text); got != n {
+			t.Errorf("%q: %d", text, got)
+		}
+	}
+}
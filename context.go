@@ -15,6 +15,8 @@ type Context struct {
 	// how long to keep a stream online after the broadcaster has disconnected.
 	// if the stream does not resume within this time, all clients get dropped.
 	StreamKeepAlive time.Duration
+	// custom emoji for chats: name -> image URL, shown instead of ":name:". see `Chat.Emotes`.
+	Emotes map[string]string
 
 	cookieCodec *securecookie.SecureCookie
 }
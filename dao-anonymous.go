@@ -1,6 +1,10 @@
 package main
 
-import "sync"
+import (
+	"sort"
+	"sync"
+	"time"
+)
 
 type anonymousDAO struct {
 	active map[string]*StreamMetadata
@@ -23,7 +27,7 @@ func (d anonymousDAO) ResetUser(login string, orEmail string) (int64, string, er
 	return 0, "", ErrNotSupported
 }
 
-func (d anonymousDAO) ResetUserStep2(id int64, token string, password []byte) error {
+func (d anonymousDAO) ResetUserStep2(id int64, token string, password []byte, ip string) error {
 	return ErrUserNotExist
 }
 
@@ -31,26 +35,70 @@ func (d anonymousDAO) ActivateUser(id int64, token string) error {
 	return ErrUserNotExist
 }
 
+func (d anonymousDAO) RenewActivationToken(id int64) (string, error) {
+	return "", ErrUserNotExist
+}
+
 func (d anonymousDAO) GetUserID(login string, password []byte) (int64, error) {
 	return 0, ErrUserNotExist
 }
 
+func (d anonymousDAO) SetUserAvatar(id int64, url string) error {
+	return ErrNotSupported
+}
+
+func (d anonymousDAO) RecordAuditEvent(id int64, kind string, detail string, ip string) error {
+	return ErrNotSupported
+}
+
+func (d anonymousDAO) AuditLog(id int64, limit int) ([]AuditEntry, error) {
+	return nil, ErrUserNotExist
+}
+
+func (d anonymousDAO) Follow(follower int64, target int64) error {
+	return ErrNotSupported
+}
+
+func (d anonymousDAO) Unfollow(follower int64, target int64) error {
+	return ErrNotSupported
+}
+
+func (d anonymousDAO) Followers(target int64) ([]UserData, error) {
+	return []UserData{}, nil
+}
+
+func (d anonymousDAO) Following(follower int64) ([]UserData, error) {
+	return []UserData{}, nil
+}
+
+func (d anonymousDAO) DeleteUser(id int64, password []byte) error {
+	return ErrUserNotExist
+}
+
 func (d anonymousDAO) GetUserFull(id int64) (*UserData, error) {
 	return nil, ErrUserNotExist
 }
 
-func (d anonymousDAO) SetUserData(id int64, name string, login string, email string, about string, password []byte) (string, error) {
+func (d anonymousDAO) SetUserData(id int64, name string, login string, email string, about string, password []byte, ip string) (string, error) {
 	return "", ErrNotSupported
 }
 
-func (d anonymousDAO) NewStreamToken(id int64) error {
-	return ErrNotSupported
+func (d anonymousDAO) NewStreamToken(id int64) (string, error) {
+	return "", ErrNotSupported
 }
 
 func (d anonymousDAO) SetStreamName(id int64, name string, nsfw bool) error {
 	return ErrNotSupported
 }
 
+func (d anonymousDAO) SetStreamCategory(id int64, category string) error {
+	return ErrNotSupported
+}
+
+func (d anonymousDAO) SetStreamSchedule(id int64, at time.Time) error {
+	return ErrNotSupported
+}
+
 func (d anonymousDAO) AddStreamPanel(id int64, text string) error {
 	return ErrNotSupported
 }
@@ -66,7 +114,7 @@ func (d anonymousDAO) DelStreamPanel(id int64, n int64) error {
 func (d anonymousDAO) StartStream(id string, token string) error {
 	d.Lock()
 	if _, ok := d.active[id]; !ok {
-		d.active[id] = &StreamMetadata{StreamTrackInfo: StreamTrackInfo{HasVideo: true, HasAudio: true}}
+		d.active[id] = &StreamMetadata{Login: id, Started: time.Now(), StreamTrackInfo: StreamTrackInfo{HasVideo: true, HasAudio: true}}
 	}
 	d.Unlock()
 	return nil
@@ -99,6 +147,40 @@ func (d anonymousDAO) GetStreamMetadata(id string) (*StreamMetadata, error) {
 	return nil, ErrStreamNotExist
 }
 
+func (d anonymousDAO) ListStreams(offset int, limit int) ([]StreamMetadata, int, error) {
+	d.RLock()
+	r := make([]StreamMetadata, 0, len(d.active))
+	for _, info := range d.active {
+		r = append(r, *info)
+	}
+	d.RUnlock()
+	sort.Slice(r, func(i, j int) bool {
+		if r[i].Started.Equal(r[j].Started) {
+			return r[i].Login > r[j].Login
+		}
+		return r[i].Started.After(r[j].Started)
+	})
+	total := len(r)
+	if offset > len(r) {
+		offset = len(r)
+	}
+	if r = r[offset:]; limit >= 0 && limit < len(r) {
+		r = r[:limit]
+	}
+	return r, total, nil
+}
+
+func (d anonymousDAO) StreamsByCategory(category string, offset int, limit int) ([]StreamMetadata, int, error) {
+	if category == "" {
+		return d.ListStreams(offset, limit)
+	}
+	return []StreamMetadata{}, 0, nil
+}
+
+func (d anonymousDAO) UpcomingStreams(offset int, limit int) ([]StreamMetadata, int, error) {
+	return []StreamMetadata{}, 0, nil
+}
+
 func (d anonymousDAO) SetStreamTrackInfo(id string, info *StreamTrackInfo) error {
 	d.RLock()
 	if item, ok := d.active[id]; ok {
@@ -125,3 +207,31 @@ func (d anonymousDAO) StartRecording(id string, filename string) (recid int64, s
 func (d anonymousDAO) StopRecording(id string, recid int64, size int64) error {
 	return nil
 }
+
+func (d anonymousDAO) AppendChatMessage(id string, msg ChatMessage) error {
+	return nil
+}
+
+func (d anonymousDAO) RecentChatMessages(id string, n int) ([]ChatMessage, error) {
+	return nil, nil
+}
+
+func (d anonymousDAO) DeleteChatMessage(id string, msgid int64) error {
+	return nil
+}
+
+func (d anonymousDAO) BanChatUser(id string, login string) error {
+	return nil
+}
+
+func (d anonymousDAO) UnbanChatUser(id string, login string) error {
+	return nil
+}
+
+func (d anonymousDAO) IsChatBanned(id string, login string) (bool, error) {
+	return false, nil
+}
+
+func (d anonymousDAO) IsNameRegistered(name string) (bool, error) {
+	return false, nil
+}
@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"reflect"
 	"sync"
+	"time"
 )
 
 type sqlDAO struct {
@@ -20,15 +21,39 @@ type sqlDAO struct {
 		UserExists      *sql.Stmt "select 1 from users where login = ? or email = ?"
 		NewUser         *sql.Stmt "insert into users(actoken, sectoken, name, login, email, pwhash) values(?, ?, ?, ?, ?, ?)"
 		NewStream       *sql.Stmt "insert into streams(user) values(?)"
-		ResetUser       *sql.Stmt "update users set rstoken = ? where id = ?"
-		ResetUserStep2  *sql.Stmt "update users set pwhash = ?, rstoken = null where id = ? and rstoken = ?"
+		ResetUser       *sql.Stmt "update users set rstoken = ?, rsexpires = datetime('now', '+1 day') where id = ?"
+		ResetUserStep2  *sql.Stmt "update users set pwhash = ?, rstoken = null where id = ? and rstoken = ? and rsexpires > datetime('now')"
+		SetUserAvatar   *sql.Stmt "update users set avatar = ? where id = ?"
 		ActivateUser    *sql.Stmt "update users set actoken = NULL where id = ? and actoken = ?"
-		GetUserID       *sql.Stmt "select id, pwhash from users where login = ?"
+		GetActivated    *sql.Stmt "select actoken is null from users where id = ?"
+		RenewActivation *sql.Stmt "update users set actoken = ? where id = ? and actoken is not null"
+		DelUser         *sql.Stmt "delete from users where id = ? and not exists(select 1 from streams where user = users.id and server is not null)"
+		DelUserPanels   *sql.Stmt "delete from panels where stream in (select id from streams where user = ?)"
+		DelUserChat     *sql.Stmt "delete from chat where stream in (select id from streams where user = ?)"
+		DelUserBans     *sql.Stmt "delete from chatbans where stream in (select id from streams where user = ?)"
+		DelUserRecords  *sql.Stmt "delete from recordings where user = ?"
+		DelUserStream   *sql.Stmt "delete from streams where user = ?"
+		DelUserFollows  *sql.Stmt "delete from follows where ? in (follower, target)"
+		DelUserAudit    *sql.Stmt "delete from audit where user = ?"
+		AddAuditEvent   *sql.Stmt "insert into audit(user, kind, detail, ip) values(?, ?, ?, ?)"
+		GetAuditLog     *sql.Stmt "select kind, detail, ip, created from audit where user = ? order by id desc limit ?"
+		Follow          *sql.Stmt "insert or ignore into follows(follower, target) select ?, id from users where id = ?"
+		Unfollow        *sql.Stmt "delete from follows where follower = ? and target = ?"
+		GetFollowers    *sql.Stmt "select id, login, name, email from users where id in (select follower from follows where target = ?) order by login"
+		GetFollowing    *sql.Stmt "select id, login, name, email from users where id in (select target from follows where follower = ?) order by login"
+		UserIDExists    *sql.Stmt "select 1 from users where id = ?"
+		GetUserID       *sql.Stmt "select id, pwhash from users where login = ? or email = ? order by login = ? desc limit 1"
 		GetUserByEither *sql.Stmt "select id from users where login = ? or email = ?"
-		GetUserInfo     *sql.Stmt "select name, login, email, pwhash, about, actoken, sectoken from users where id = ?"
-		GetStreamInfo   *sql.Stmt "select users.id, users.name, about, email, streams.name, server, video, audio, width, height, nsfw, streams.id from users join streams on users.id = streams.user where login = ?"
-		SetStreamToken  *sql.Stmt "update users set sectoken = ? where id = ?"
+		GetUserInfo     *sql.Stmt "select name, login, email, avatar, pwhash, about, actoken, sectoken from users where id = ?"
+		GetStreamInfo   *sql.Stmt "select users.id, login, users.name, about, email, avatar, streams.name, server, video, audio, width, height, nsfw, category, started, scheduled, streams.id from users join streams on users.id = streams.user where login = ?"
+		GetLiveStreams  *sql.Stmt "select users.id, login, users.name, about, email, avatar, streams.name, server, video, audio, width, height, nsfw, category, started, scheduled from users join streams on users.id = streams.user where server is not null and (? = '' or lower(category) = lower(?)) order by started desc, streams.id desc limit ? offset ?"
+		GetPlanned      *sql.Stmt "select users.id, login, users.name, about, email, avatar, streams.name, server, video, audio, width, height, nsfw, category, started, scheduled from users join streams on users.id = streams.user where server is null and datetime(scheduled) > datetime('now') order by datetime(scheduled), streams.id limit ? offset ?"
+		CntPlanned      *sql.Stmt "select count(*) from streams where server is null and datetime(scheduled) > datetime('now')"
+		SetSchedule     *sql.Stmt "update streams set scheduled = ? where user = ?"
+		CntLiveStreams  *sql.Stmt "select count(*) from streams where server is not null and (? = '' or lower(category) = lower(?))"
+		SetStreamToken  *sql.Stmt "update users set sectoken = ? where id = ? and not exists(select 1 from streams where user = users.id and server is not null)"
 		SetStreamName   *sql.Stmt "update streams set name = ?, nsfw = ? where user = ?"
+		SetStreamCateg  *sql.Stmt "update streams set category = ? where user = ?"
 		SetStreamTracks *sql.Stmt "update streams set video = ?, audio = ?, width = ?, height = ? where user in (select id from users where login = ?)"
 		GetStreamPanels *sql.Stmt "select text, image, created from panels where stream = ?"
 		AddStreamPanel  *sql.Stmt "insert into panels(stream, text) select id, ? from streams where user = ?"
@@ -36,12 +61,19 @@ type sqlDAO struct {
 		DelStreamPanel  *sql.Stmt "delete from panels where id in (select id from panels where stream in (select id from streams where user = ?) limit 1 offset ?)"
 		GetStreamAuth   *sql.Stmt "select server, sectoken, actoken is null from users join streams on users.id = streams.user where users.login = ?"
 		GetStreamServer *sql.Stmt "select server from streams where user in (select id from users where login = ?)"
-		SetStreamServer *sql.Stmt "update streams set server = ? where server is null and user in (select id from users where login = ? and actoken is null and sectoken = ?)"
+		SetStreamServer *sql.Stmt "update streams set server = ?, started = datetime('now'), scheduled = null where server is null and user in (select id from users where login = ? and actoken is null and sectoken = ?)"
 		DelStreamServer *sql.Stmt "update streams set server = null where user in (select id from users where login = ?)"
-		GetRecordings1  *sql.Stmt "select id, name, about, email, space_total from users where login = ?"
+		GetRecordings1  *sql.Stmt "select id, name, about, email, avatar, space_total from users where login = ?"
 		GetRecordings2  *sql.Stmt "select id, name, server, path, created, size from recordings where user = ? order by datetime(created) desc"
 		GetRecordPanels *sql.Stmt "select text, image, created from panels where stream = ? and datetime(created) <= datetime(?)"
-		GetRecording    *sql.Stmt "select users.id, users.name, about, email, recordings.name, server, video, audio, width, height, nsfw, path, size, created, stream from users join recordings on users.id = user where recordings.id = ?"
+		GetRecording    *sql.Stmt "select users.id, users.name, about, email, avatar, recordings.name, server, video, audio, width, height, nsfw, path, size, created, stream from users join recordings on users.id = user where recordings.id = ?"
+		AddChatMessage  *sql.Stmt "insert into chat(stream, msgid, name, login, text, action, created) select streams.id, ?, ?, ?, ?, ?, ? from streams join users on users.id = streams.user where users.login = ?"
+		GetChatMessages *sql.Stmt "select msgid, name, login, text, action, created from (select * from chat where stream in (select streams.id from streams join users on users.id = streams.user where users.login = ?) order by id desc limit ?) order by id"
+		DelChatMessage  *sql.Stmt "delete from chat where msgid = ? and stream in (select streams.id from streams join users on users.id = streams.user where users.login = ?)"
+		BanChatUser     *sql.Stmt "insert or ignore into chatbans(stream, login) select streams.id, ? from streams join users on users.id = streams.user where users.login = ?"
+		UnbanChatUser   *sql.Stmt "delete from chatbans where login = ? and stream in (select streams.id from streams join users on users.id = streams.user where users.login = ?)"
+		IsChatBanned    *sql.Stmt "select 1 from chatbans where login = ? and stream in (select streams.id from streams join users on users.id = streams.user where users.login = ?)"
+		NameRegistered  *sql.Stmt "select 1 from users where name = ?"
 	}
 }
 
@@ -50,12 +82,14 @@ create table if not exists users (
     id           integer      not null primary key,
     actoken      varchar(64),
     rstoken      varchar(64),
+    rsexpires    datetime,
     sectoken     varchar(64)  not null,
     name         varchar(256) not null,
     login        varchar(256) not null,
     email        varchar(256) not null,
     pwhash       varchar(256) not null,
     about        text         not null default "",
+    avatar       varchar(256) not null default "",
     space_total  integer      not null default 0,
     unique(login), unique(email)
 );
@@ -69,7 +103,10 @@ create table if not exists streams (
     width      integer      not null default 0,
     height     integer      not null default 0,
     name       varchar(256) not null default "",
-    server     varchar(128)
+    category   varchar(64)  not null default "",
+    server     varchar(128),
+    started    datetime,
+    scheduled  datetime
 );
 
 create table if not exists panels (
@@ -94,8 +131,54 @@ create table if not exists recordings (
     path       varchar(256) not null,
     created    datetime     not null default (datetime('now')),
     size       integer      not null default 0
+);
+
+create table if not exists follows (
+    id        integer      not null primary key,
+    follower  integer      not null,
+    target    integer      not null,
+    created   datetime     not null default (datetime('now')),
+    unique(follower, target)
+);
+
+create table if not exists audit (
+    id        integer      not null primary key,
+    user      integer      not null,
+    kind      varchar(32)  not null,
+    detail    varchar(256) not null default "",
+    ip        varchar(64)  not null default "",
+    created   datetime     not null default (datetime('now'))
+);
+
+create table if not exists chat (
+    id        integer      not null primary key,
+    stream    integer      not null,
+    msgid     integer      not null,
+    name      varchar(256) not null,
+    login     varchar(256) not null default "",
+    text      text         not null,
+    action    boolean      not null default 0,
+    created   datetime     not null default (datetime('now'))
+);
+
+create table if not exists chatbans (
+    id        integer      not null primary key,
+    stream    integer      not null,
+    login     varchar(256) not null,
+    created   datetime     not null default (datetime('now')),
+    unique(stream, login)
 );`
 
+// Columns added after a table was first created. `create table if not exists` leaves
+// existing tables as they are, so these have to be added separately.
+var sqlColumns = []struct{ table, column, definition string }{
+	{"users", "rsexpires", "datetime"},
+	{"streams", "started", "datetime"},
+	{"streams", "category", "varchar(64) not null default \"\""},
+	{"users", "avatar", "varchar(256) not null default \"\""},
+	{"streams", "scheduled", "datetime"},
+}
+
 func NewSQLDatabase(localhost string, driver string, server string) (Database, error) {
 	db, err := sql.Open(driver, server)
 	if err == nil {
@@ -112,6 +195,15 @@ func (d *sqlDAO) prepare() error {
 	if _, err := d.Exec(sqlSchema); err != nil {
 		return err
 	}
+	for _, c := range sqlColumns {
+		exists, err := d.hasColumn(c.table, c.column)
+		if err == nil && !exists {
+			_, err = d.Exec("alter table " + c.table + " add column " + c.column + " " + c.definition)
+		}
+		if err != nil {
+			return err
+		}
+	}
 	t := reflect.TypeOf(&d.prepared).Elem()
 	v := reflect.ValueOf(&d.prepared).Elem()
 	for i := 0; i < t.NumField(); i++ {
@@ -124,6 +216,28 @@ func (d *sqlDAO) prepare() error {
 	return nil
 }
 
+func (d *sqlDAO) hasColumn(table string, column string) (bool, error) {
+	rows, err := d.Query("pragma table_info(" + table + ")")
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			cid, notnull, pk int
+			name, kind       string
+			value            sql.NullString
+		)
+		if err := rows.Scan(&cid, &name, &kind, &notnull, &value, &pk); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
 func (d *sqlDAO) userExists(login string, email string) bool {
 	var i int
 	return d.prepared.UserExists.QueryRow(login, email).Scan(&i) != sql.ErrNoRows
@@ -136,7 +250,7 @@ func (d *sqlDAO) NewUser(login string, email string, password []byte) (*UserData
 	if err := ValidateEmail(email); err != nil {
 		return nil, err
 	}
-	hash, err := hashPassword(password)
+	hash, err := HashPassword(password)
 	if err != nil {
 		return nil, err
 	}
@@ -154,7 +268,7 @@ func (d *sqlDAO) NewUser(login string, email string, password []byte) (*UserData
 	if err == nil {
 		_, err = d.prepared.NewStream.Exec(uid)
 	}
-	return &UserData{uid, login, email, login, hash, "", false, actoken, sectoken}, err
+	return &UserData{uid, login, email, login, hash, "", "", false, actoken, sectoken}, err
 }
 
 func (d *sqlDAO) ResetUser(login string, orEmail string) (uid int64, token string, err error) {
@@ -169,8 +283,8 @@ func (d *sqlDAO) ResetUser(login string, orEmail string) (uid int64, token strin
 	return
 }
 
-func (d *sqlDAO) ResetUserStep2(id int64, token string, password []byte) error {
-	hash, err := hashPassword(password)
+func (d *sqlDAO) ResetUserStep2(id int64, token string, password []byte, ip string) error {
+	hash, err := HashPassword(password)
 	if err != nil {
 		return err
 	}
@@ -180,7 +294,10 @@ func (d *sqlDAO) ResetUserStep2(id int64, token string, password []byte) error {
 	}
 	changed, err := r.RowsAffected()
 	if err == nil && changed != 1 {
-		return ErrUserNotExist
+		return ErrInvalidToken
+	}
+	if err == nil {
+		err = d.RecordAuditEvent(id, "password-reset", "", ip)
 	}
 	return err
 }
@@ -190,29 +307,136 @@ func (d *sqlDAO) ActivateUser(id int64, token string) error {
 	if err != nil {
 		return err
 	}
-	changed, err := r.RowsAffected()
-	if err == nil && changed != 1 {
+	if changed, err := r.RowsAffected(); err != nil || changed == 1 {
+		return err
+	}
+	var activated bool
+	switch err = d.prepared.GetActivated.QueryRow(id).Scan(&activated); {
+	case err == sql.ErrNoRows:
+		return ErrUserNotExist
+	case err == nil && !activated:
 		return ErrInvalidToken
 	}
 	return err
 }
 
+func (d *sqlDAO) RenewActivationToken(id int64) (string, error) {
+	token := makeToken(tokenLength)
+	r, err := d.prepared.RenewActivation.Exec(token, id)
+	if err != nil {
+		return "", err
+	}
+	if rows, err := r.RowsAffected(); err != nil || rows == 1 {
+		return token, err
+	}
+	var i int
+	if d.prepared.UserIDExists.QueryRow(id).Scan(&i) == sql.ErrNoRows {
+		return "", ErrUserNotExist
+	}
+	return "", ErrAlreadyActive
+}
+
 func (d *sqlDAO) GetUserID(login string, password []byte) (int64, error) {
 	var u UserData
-	err := d.prepared.GetUserID.QueryRow(login).Scan(&u.ID, &u.PwHash)
+	err := d.prepared.GetUserID.QueryRow(login, login, login).Scan(&u.ID, &u.PwHash)
 	if err == sql.ErrNoRows {
-		err = ErrUserNotExist
-	} else if err == nil {
+		// `CheckPassword(nil, ...)` still spends time hashing to not reveal
+		// whether the login exists.
+		err = nil
+	}
+	if err == nil {
 		err = u.CheckPassword(password)
 	}
 	return u.ID, err
 }
 
+func (d *sqlDAO) DeleteUser(id int64, password []byte) error {
+	u, err := d.GetUserFull(id)
+	if err != nil {
+		return err
+	}
+	if err = u.CheckPassword(password); err != nil {
+		return err
+	}
+	tx, err := d.Begin()
+	if err != nil {
+		return err
+	}
+	r, err := tx.Stmt(d.prepared.DelUser).Exec(id)
+	if err == nil {
+		var rows int64
+		if rows, err = r.RowsAffected(); err == nil && rows != 1 {
+			err = ErrStreamActive
+		}
+	}
+	for _, stmt := range []*sql.Stmt{d.prepared.DelUserPanels, d.prepared.DelUserChat, d.prepared.DelUserBans, d.prepared.DelUserRecords, d.prepared.DelUserStream, d.prepared.DelUserFollows, d.prepared.DelUserAudit} {
+		if err == nil {
+			_, err = tx.Stmt(stmt).Exec(id)
+		}
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (d *sqlDAO) SetUserAvatar(id int64, url string) error {
+	if err := ValidateAvatarURL(url); err != nil {
+		return err
+	}
+	return errOf(d.prepared.SetUserAvatar.Exec(url, id))
+}
+
+func (d *sqlDAO) Follow(follower int64, target int64) error {
+	if follower == target {
+		return ErrFollowSelf
+	}
+	r, err := d.prepared.Follow.Exec(follower, target)
+	if err != nil {
+		return err
+	}
+	if rows, err := r.RowsAffected(); err != nil || rows == 1 {
+		return err
+	}
+	// either already following or there is no such user.
+	var i int
+	if d.prepared.UserIDExists.QueryRow(target).Scan(&i) == sql.ErrNoRows {
+		return ErrUserNotExist
+	}
+	return nil
+}
+
+func (d *sqlDAO) Unfollow(follower int64, target int64) error {
+	return errOf(d.prepared.Unfollow.Exec(follower, target))
+}
+
+func (d *sqlDAO) Followers(target int64) ([]UserData, error) {
+	return d.loadUsers(d.prepared.GetFollowers.Query(target))
+}
+
+func (d *sqlDAO) Following(follower int64) ([]UserData, error) {
+	return d.loadUsers(d.prepared.GetFollowing.Query(follower))
+}
+
+func (d *sqlDAO) loadUsers(rows *sql.Rows, err error) ([]UserData, error) {
+	if err != nil {
+		return nil, err
+	}
+	r := make([]UserData, 0)
+	u := UserData{}
+	for rows.Next() && rows.Scan(&u.ID, &u.Login, &u.Name, &u.Email) == nil {
+		r = append(r, u)
+	}
+	rows.Close()
+	return r, rows.Err()
+}
+
 func (d *sqlDAO) GetUserFull(id int64) (*UserData, error) {
 	var actoken sql.NullString
 	u := UserData{ID: id}
 	err := d.prepared.GetUserInfo.QueryRow(id).Scan(
-		&u.Name, &u.Login, &u.Email, &u.PwHash, &u.About, &actoken, &u.StreamToken,
+		&u.Name, &u.Login, &u.Email, &u.AvatarURL, &u.PwHash, &u.About, &actoken, &u.StreamToken,
 	)
 	if err == sql.ErrNoRows {
 		return nil, ErrUserNotExist
@@ -223,7 +447,7 @@ func (d *sqlDAO) GetUserFull(id int64) (*UserData, error) {
 	return &u, err
 }
 
-func (d *sqlDAO) SetUserData(id int64, name string, login string, email string, about string, password []byte) (string, error) {
+func (d *sqlDAO) SetUserData(id int64, name string, login string, email string, about string, password []byte, ip string) (string, error) {
 	token := ""
 	query := "update users set rstoken = null, "
 	params := make([]interface{}, 0, 7)
@@ -254,7 +478,7 @@ func (d *sqlDAO) SetUserData(id int64, name string, login string, email string,
 	}
 
 	if len(password) != 0 {
-		hash, err := hashPassword(password)
+		hash, err := HashPassword(password)
 		if err != nil {
 			return "", err
 		}
@@ -279,23 +503,72 @@ func (d *sqlDAO) SetUserData(id int64, name string, login string, email string,
 	if err == nil && rows != 1 {
 		return "", ErrStreamActive
 	}
+	if err == nil && login != "" {
+		err = d.RecordAuditEvent(id, "login", login, ip)
+	}
+	if err == nil && email != "" {
+		err = d.RecordAuditEvent(id, "email", email, ip)
+	}
+	if err == nil && len(password) != 0 {
+		err = d.RecordAuditEvent(id, "password", "", ip)
+	}
 	return token, err
 }
 
+func (d *sqlDAO) RecordAuditEvent(id int64, kind string, detail string, ip string) error {
+	return errOf(d.prepared.AddAuditEvent.Exec(id, kind, detail, ip))
+}
+
+func (d *sqlDAO) AuditLog(id int64, limit int) ([]AuditEntry, error) {
+	rows, err := d.prepared.GetAuditLog.Query(id, limit)
+	if err != nil {
+		return nil, err
+	}
+	r := make([]AuditEntry, 0)
+	entry := AuditEntry{}
+	for rows.Next() && rows.Scan(&entry.Kind, &entry.Detail, &entry.IP, &entry.Time) == nil {
+		r = append(r, entry)
+	}
+	rows.Close()
+	return r, rows.Err()
+}
+
 func errOf(_ interface{}, err error) error {
 	return err
 }
 
-func (d *sqlDAO) NewStreamToken(id int64) error {
-	// TODO invalidate token cache on all nodes
-	//      damn, it appears I ran into the most difficult problem...
-	return errOf(d.prepared.SetStreamToken.Exec(makeToken(tokenLength), id))
+func (d *sqlDAO) NewStreamToken(id int64) (string, error) {
+	// only while offline, so no node has the old token cached; see `StopStream`.
+	token := makeToken(tokenLength)
+	r, err := d.prepared.SetStreamToken.Exec(token, id)
+	if err != nil {
+		return "", err
+	}
+	rows, err := r.RowsAffected()
+	if err != nil {
+		return "", err
+	}
+	if rows == 1 {
+		return token, nil
+	}
+	var i int
+	if d.prepared.UserIDExists.QueryRow(id).Scan(&i) == sql.ErrNoRows {
+		return "", ErrUserNotExist
+	}
+	return "", ErrStreamActive
 }
 
 func (d *sqlDAO) SetStreamName(id int64, name string, nsfw bool) error {
 	return errOf(d.prepared.SetStreamName.Exec(name, nsfw, id))
 }
 
+func (d *sqlDAO) SetStreamCategory(id int64, category string) error {
+	if err := ValidateCategory(category); err != nil {
+		return err
+	}
+	return errOf(d.prepared.SetStreamCateg.Exec(category, id))
+}
+
 func (d *sqlDAO) AddStreamPanel(id int64, text string) error {
 	return errOf(d.prepared.AddStreamPanel.Exec(text, id))
 }
@@ -386,10 +659,11 @@ func (d *sqlDAO) GetStreamServer(id string) (string, error) {
 func (d *sqlDAO) GetStreamMetadata(id string) (*StreamMetadata, error) {
 	var intId int
 	var server sql.NullString
+	var started, scheduled *time.Time
 	meta := StreamMetadata{}
 	err := d.prepared.GetStreamInfo.QueryRow(id).Scan(
-		&meta.OwnerID, &meta.UserName, &meta.UserAbout, &meta.Email, &meta.Name, &server,
-		&meta.HasVideo, &meta.HasAudio, &meta.Width, &meta.Height, &meta.NSFW, &intId,
+		&meta.OwnerID, &meta.Login, &meta.UserName, &meta.UserAbout, &meta.Email, &meta.AvatarURL, &meta.Name, &server,
+		&meta.HasVideo, &meta.HasAudio, &meta.Width, &meta.Height, &meta.NSFW, &meta.Category, &started, &scheduled, &intId,
 	)
 	if err == sql.ErrNoRows {
 		return nil, ErrStreamNotExist
@@ -397,6 +671,12 @@ func (d *sqlDAO) GetStreamMetadata(id string) (*StreamMetadata, error) {
 	if err != nil {
 		return nil, err
 	}
+	if started != nil {
+		meta.Started = *started
+	}
+	if scheduled != nil {
+		meta.ScheduledAt = *scheduled
+	}
 	rows, err := d.prepared.GetStreamPanels.Query(intId)
 	if err == nil {
 		meta.Panels, err = d.loadPanelsFromRows(rows)
@@ -408,6 +688,66 @@ func (d *sqlDAO) GetStreamMetadata(id string) (*StreamMetadata, error) {
 	return &meta, err
 }
 
+func (d *sqlDAO) ListStreams(offset int, limit int) ([]StreamMetadata, int, error) {
+	return d.StreamsByCategory("", offset, limit)
+}
+
+func (d *sqlDAO) StreamsByCategory(category string, offset int, limit int) ([]StreamMetadata, int, error) {
+	var total int
+	if err := d.prepared.CntLiveStreams.QueryRow(category, category).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	r, err := d.loadStreamsFromRows(d.prepared.GetLiveStreams.Query(category, category, limit, offset))
+	return r, total, err
+}
+
+func (d *sqlDAO) SetStreamSchedule(id int64, at time.Time) error {
+	if at.IsZero() {
+		return errOf(d.prepared.SetSchedule.Exec(nil, id))
+	}
+	if !at.After(time.Now()) {
+		return ErrScheduleInPast
+	}
+	return errOf(d.prepared.SetSchedule.Exec(at.UTC(), id))
+}
+
+func (d *sqlDAO) UpcomingStreams(offset int, limit int) ([]StreamMetadata, int, error) {
+	var total int
+	if err := d.prepared.CntPlanned.QueryRow().Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	r, err := d.loadStreamsFromRows(d.prepared.GetPlanned.Query(limit, offset))
+	return r, total, err
+}
+
+func (d *sqlDAO) loadStreamsFromRows(rows *sql.Rows, err error) ([]StreamMetadata, error) {
+	if err != nil {
+		return nil, err
+	}
+	r := make([]StreamMetadata, 0)
+	for rows.Next() {
+		var server sql.NullString
+		var started, scheduled *time.Time
+		meta := StreamMetadata{}
+		if err := rows.Scan(
+			&meta.OwnerID, &meta.Login, &meta.UserName, &meta.UserAbout, &meta.Email, &meta.AvatarURL, &meta.Name, &server,
+			&meta.HasVideo, &meta.HasAudio, &meta.Width, &meta.Height, &meta.NSFW, &meta.Category, &started, &scheduled,
+		); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if meta.Server = server.String; started != nil {
+			meta.Started = *started
+		}
+		if scheduled != nil {
+			meta.ScheduledAt = *scheduled
+		}
+		r = append(r, meta)
+	}
+	rows.Close()
+	return r, rows.Err()
+}
+
 func (d *sqlDAO) loadPanelsFromRows(rows *sql.Rows) ([]StreamMetadataPanel, error) {
 	r := make([]StreamMetadataPanel, 0, 5)
 	panel := StreamMetadataPanel{}
@@ -424,7 +764,7 @@ func (d *sqlDAO) SetStreamTrackInfo(id string, info *StreamTrackInfo) error {
 
 func (d *sqlDAO) GetRecordings(id string) (*StreamHistory, error) {
 	h := StreamHistory{}
-	err := d.prepared.GetRecordings1.QueryRow(id).Scan(&h.OwnerID, &h.UserName, &h.UserAbout, &h.Email, &h.SpaceLimit)
+	err := d.prepared.GetRecordings1.QueryRow(id).Scan(&h.OwnerID, &h.UserName, &h.UserAbout, &h.Email, &h.AvatarURL, &h.SpaceLimit)
 	if err == sql.ErrNoRows {
 		err = ErrStreamNotExist
 	}
@@ -448,7 +788,7 @@ func (d *sqlDAO) GetRecording(id string, recid int64) (*StreamRecording, error)
 	var intId int
 	r := StreamRecording{}
 	err := d.prepared.GetRecording.QueryRow(recid).Scan(
-		&r.OwnerID, &r.UserName, &r.UserAbout, &r.Email, &r.Name, &r.Server, &r.HasVideo,
+		&r.OwnerID, &r.UserName, &r.UserAbout, &r.Email, &r.AvatarURL, &r.Name, &r.Server, &r.HasVideo,
 		&r.HasAudio, &r.Width, &r.Height, &r.NSFW, &r.Path, &r.Space, &r.Timestamp, &intId,
 	)
 	if err == sql.ErrNoRows {
@@ -471,3 +811,57 @@ func (d *sqlDAO) StartRecording(id string, filename string) (recid int64, sizeLi
 func (d *sqlDAO) StopRecording(id string, recid int64, size int64) error {
 	return nil
 }
+
+func (d *sqlDAO) AppendChatMessage(id string, msg ChatMessage) error {
+	return errOf(d.prepared.AddChatMessage.Exec(msg.id, msg.name, msg.login, msg.text, msg.action, msg.time, id))
+}
+
+func (d *sqlDAO) RecentChatMessages(id string, n int) ([]ChatMessage, error) {
+	rows, err := d.prepared.GetChatMessages.Query(id, n)
+	if err != nil {
+		return nil, err
+	}
+	r := make([]ChatMessage, 0, n)
+	msg := ChatMessage{}
+	for rows.Next() && rows.Scan(&msg.id, &msg.name, &msg.login, &msg.text, &msg.action, &msg.time) == nil {
+		r = append(r, msg)
+	}
+	rows.Close()
+	return r, rows.Err()
+}
+
+func (d *sqlDAO) DeleteChatMessage(id string, msgid int64) error {
+	return errOf(d.prepared.DelChatMessage.Exec(msgid, id))
+}
+
+func (d *sqlDAO) BanChatUser(id string, login string) error {
+	return errOf(d.prepared.BanChatUser.Exec(login, id))
+}
+
+func (d *sqlDAO) UnbanChatUser(id string, login string) error {
+	return errOf(d.prepared.UnbanChatUser.Exec(login, id))
+}
+
+func (d *sqlDAO) IsChatBanned(id string, login string) (bool, error) {
+	var one int
+	switch err := d.prepared.IsChatBanned.QueryRow(login, id).Scan(&one); err {
+	case sql.ErrNoRows:
+		return false, nil
+	case nil:
+		return true, nil
+	default:
+		return false, err
+	}
+}
+
+func (d *sqlDAO) IsNameRegistered(name string) (bool, error) {
+	var one int
+	switch err := d.prepared.NameRegistered.QueryRow(name).Scan(&one); err {
+	case sql.ErrNoRows:
+		return false, nil
+	case nil:
+		return true, nil
+	default:
+		return false, err
+	}
+}
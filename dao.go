@@ -14,15 +14,20 @@ import (
 var (
 	ErrNotSupported    = errors.New("Unsupported operation.")
 	ErrInvalidEmail    = errors.New("Email does not look correct.")
+	ErrInvalidURL      = errors.New("Only http:// and https:// links are allowed.")
 	ErrInvalidPassword = errors.New("Cannot choose this password.")
 	ErrInvalidToken    = errors.New("Invalid token.")
+	ErrAlreadyActive   = errors.New("This account is already activated.")
 	ErrInvalidUsername = errors.New("Cannot choose this username.")
+	ErrInvalidCategory = errors.New("Category names must be at most 64 characters.")
 	ErrUserNotExist    = errors.New("Invalid username/password.")
 	ErrUserNotUnique   = errors.New("This name/email is already taken.")
+	ErrFollowSelf      = errors.New("Can't follow yourself.")
 	ErrStreamActive    = errors.New("Can't do that while a stream is active.")
 	ErrStreamNotExist  = errors.New("Unknown stream.")
 	ErrStreamNotHere   = errors.New("Stream is online on another server.")
 	ErrStreamOffline   = errors.New("Stream is offline.")
+	ErrScheduleInPast  = errors.New("Can't schedule a stream in the past.")
 )
 
 const (
@@ -38,6 +43,32 @@ func makeToken(length int) string {
 	return string(xs)
 }
 
+// A hash of some random password, compared against when a user does not exist so that
+// failed logins take the same time either way.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte(makeToken(tokenLength)), bcrypt.DefaultCost)
+
+// All implementations of `Database` must store passwords hashed with this...
+func HashPassword(password []byte) ([]byte, error) {
+	if len(password) < 4 || len(password) > 128 {
+		return []byte{}, ErrInvalidPassword
+	}
+	return bcrypt.GenerateFromPassword(password, bcrypt.DefaultCost)
+}
+
+// ...and check them with this, which takes constant time. A nil hash (no such user)
+// is still compared against something; the result is always `ErrUserNotExist`.
+func CheckPassword(hash []byte, password []byte) error {
+	if hash == nil {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, password)
+		return ErrUserNotExist
+	}
+	err := bcrypt.CompareHashAndPassword(hash, password)
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return ErrUserNotExist
+	}
+	return err
+}
+
 type UserData struct {
 	ID              int64
 	Login           string
@@ -45,23 +76,37 @@ type UserData struct {
 	Name            string
 	PwHash          []byte
 	About           string
+	AvatarURL       string // If empty, Gravatar is used.
 	Activated       bool
 	ActivationToken string
 	StreamToken     string
 }
 
 type StreamMetadata struct {
+	Login     string // The ID of the stream.
 	UserName  string
 	UserAbout string
 	Name      string
 	Email     string
+	AvatarURL string
 	Server    string
 	OwnerID   int64
 	NSFW      bool
+	Category  string
+	Started   time.Time // When the stream last went online, if ever.
 	Panels    []StreamMetadataPanel
+	// When the streamer plans to go online next. Cleared by `StartStream`.
+	ScheduledAt time.Time
 	StreamTrackInfo
 }
 
+type AuditEntry struct {
+	Kind   string // "login", "email", "password", or "password-reset".
+	Detail string // e.g. the new email.
+	IP     string // May be empty.
+	Time   time.Time
+}
+
 type StreamMetadataPanel struct {
 	Text    string
 	Image   string
@@ -73,6 +118,22 @@ type StreamTrackInfo struct {
 	HasAudio bool
 	Width    uint // Dimensions of the video track that came last in the `Tracks` tag.
 	Height   uint // Hopefully, there's only one video track in the file.
+	// Frames per second, from the same track's `DefaultDuration`; 0 if unknown.
+	FrameRate float64
+	Tracks    []TrackInfo
+	Metadata  map[string]string // From `SimpleTag`s, e.g. "TITLE" -> "Some Stream"
+}
+
+type TrackInfo struct {
+	Number  uint
+	Type    uint   // 1 = video, 2 = audio, etc. (See the Matroska spec.)
+	CodecID string // e.g. "V_VP8" or "A_OPUS"
+	Width   uint   // (Video tracks only.)
+	Height  uint
+	Name    string // e.g. "Commentary"; empty if not set.
+	// The language as an IETF tag (e.g. "en-US") if the broadcaster gave one, else
+	// the older ISO 639-2 code (e.g. "eng"), else empty, which by default means English.
+	Language string
 }
 
 type FileSize int64
@@ -88,6 +149,7 @@ type StreamHistory struct {
 	UserName   string
 	UserAbout  string
 	Email      string
+	AvatarURL  string
 	SpaceUsed  FileSize
 	SpaceLimit FileSize
 	OwnerID    int64
@@ -110,37 +172,29 @@ type StreamRecording struct {
 	Timestamp time.Time
 }
 
-func hashPassword(password []byte) ([]byte, error) {
-	if len(password) < 4 || len(password) > 128 {
-		return []byte{}, ErrInvalidPassword
-	}
-	return bcrypt.GenerateFromPassword(password, bcrypt.DefaultCost)
-}
-
 func (u *UserData) CheckPassword(password []byte) error {
-	err := bcrypt.CompareHashAndPassword(u.PwHash, password)
-	if err == bcrypt.ErrMismatchedHashAndPassword {
-		return ErrUserNotExist
-	}
-	return err
+	return CheckPassword(u.PwHash, password)
 }
 
-func gravatarURL(email string, size int) string {
+func avatarURL(custom string, email string, size int) string {
+	if custom != "" {
+		return custom
+	}
 	hash := md5.Sum([]byte(strings.ToLower(email)))
 	hexhash := hex.EncodeToString(hash[:])
 	return fmt.Sprintf("//www.gravatar.com/avatar/%s?s=%d", hexhash, size)
 }
 
 func (u *UserData) Avatar(size int) string {
-	return gravatarURL(u.Email, size)
+	return avatarURL(u.AvatarURL, u.Email, size)
 }
 
 func (s *StreamMetadata) Avatar(size int) string {
-	return gravatarURL(s.Email, size)
+	return avatarURL(s.AvatarURL, s.Email, size)
 }
 
 func (h *StreamHistory) Avatar(size int) string {
-	return gravatarURL(h.Email, size)
+	return avatarURL(h.AvatarURL, h.Email, size)
 }
 
 func (s FileSize) RatioOf(t FileSize) float32 {
@@ -153,7 +207,7 @@ func (s FileSize) RatioOf(t FileSize) float32 {
 func (s FileSize) String() string {
 	switch {
 	case s >= GiB:
-		return fmt.Sprintf("%.2f MiB", float32(s)/float32(GiB))
+		return fmt.Sprintf("%.2f GiB", float32(s)/float32(GiB))
 	case s >= MiB:
 		return fmt.Sprintf("%.2f MiB", float32(s)/float32(MiB))
 	case s >= KiB:
@@ -162,18 +216,50 @@ func (s FileSize) String() string {
 	return fmt.Sprintf("%d bytes", s)
 }
 
+// Passwords are given in plain text; see `HashPassword` and `CheckPassword`.
 type Database interface {
 	Close() error
 	NewUser(login string, email string, password []byte) (*UserData, error)
+	// Password reset tokens expire after a day. An expired or unknown token is
+	// an `ErrInvalidToken`.
 	ResetUser(login string, orEmail string) (uid int64, rstoken string, e error)
-	ResetUserStep2(id int64, token string, password []byte) error
+	ResetUserStep2(id int64, token string, password []byte, ip string) error
+	// Activating an already active user does nothing. Otherwise, the token must match
+	// (`ErrInvalidToken`) and the user must exist (`ErrUserNotExist`).
 	ActivateUser(id int64, token string) error
+	// Replace the activation token of a user, invalidating the old one. Fails with
+	// `ErrAlreadyActive` if there is nothing to activate.
+	RenewActivationToken(id int64) (string, error)
+	// `login` may also be an email address. (If it is someone's login, that takes
+	// precedence; logins are allowed to contain "@".)
 	GetUserID(login string, password []byte) (int64, error)
 	GetUserFull(id int64) (*UserData, error)
+	// An empty URL resets the avatar to the Gravatar one.
+	SetUserAvatar(id int64, url string) error
+	// Newest first. A negative limit means no limit.
+	AuditLog(id int64, limit int) ([]AuditEntry, error)
+	RecordAuditEvent(id int64, kind string, detail string, ip string) error
+	// Following is idempotent, as is unfollowing. The lists only contain IDs, logins,
+	// names, and emails.
+	Follow(follower int64, target int64) error
+	Unfollow(follower int64, target int64) error
+	Followers(target int64) ([]UserData, error)
+	Following(follower int64) ([]UserData, error)
+	// Remove the user along with the stream's settings, panels, chat logs, follows,
+	// audit log, and list of recordings. (The recorded files themselves are left alone.) Requires the
+	// password (`ErrUserNotExist` if wrong), fails with `ErrStreamActive` if the stream
+	// is online.
+	DeleteUser(id int64, password []byte) error
 	// v--- can assume existence of user with given id
-	SetUserData(id int64, name string, login string, email string, about string, password []byte) (actoken string, e error)
-	NewStreamToken(id int64) error
+	// Changes of login, email, and password are recorded in the audit log along with
+	// `ip`, which may be empty; so are password resets.
+	SetUserData(id int64, name string, login string, email string, about string, password []byte, ip string) (actoken string, e error)
+	// Fails with `ErrStreamActive` if the stream is online, or `ErrUserNotExist`.
+	NewStreamToken(id int64) (string, error)
 	SetStreamName(id int64, name string, nsfw bool) error
+	SetStreamCategory(id int64, category string) error
+	// A zero time clears the schedule.
+	SetStreamSchedule(id int64, at time.Time) error
 	AddStreamPanel(id int64, text string) error
 	SetStreamPanel(id int64, n int64, text string) error
 	DelStreamPanel(id int64, n int64) error
@@ -182,6 +268,14 @@ type Database interface {
 	StopStream(id string) error
 	GetStreamServer(id string) (string, error)
 	GetStreamMetadata(id string) (*StreamMetadata, error)
+	// A page of streams that are online on any server, most recently started first,
+	// plus the total number of them. `Panels` are not loaded. If there are none,
+	// the result is an empty slice and no error. A negative limit means no limit.
+	ListStreams(offset int, limit int) ([]StreamMetadata, int, error)
+	// Same, but only those in a category (case-insensitive.)
+	StreamsByCategory(category string, offset int, limit int) ([]StreamMetadata, int, error)
+	// Offline streams scheduled to start in the future, soonest first.
+	UpcomingStreams(offset int, limit int) ([]StreamMetadata, int, error)
 	SetStreamTrackInfo(id string, info *StreamTrackInfo) error
 	GetRecordings(id string) (*StreamHistory, error)
 	GetRecording(id string, recid int64) (*StreamRecording, error)
@@ -189,4 +283,16 @@ type Database interface {
 	// TODO think of how to implement this ---v
 	StartRecording(id string, filename string) (recid int64, sizeLimit int64, e error)
 	StopRecording(id string, recid int64, size int64) error
+	// Chat logs, so that they survive the stream going offline. Messages are returned
+	// oldest first.
+	AppendChatMessage(id string, msg ChatMessage) error
+	RecentChatMessages(id string, n int) ([]ChatMessage, error)
+	DeleteChatMessage(id string, msgid int64) error
+	// Logins not allowed into a stream's chat, even after it's been offline.
+	BanChatUser(id string, login string) error
+	UnbanChatUser(id string, login string) error
+	IsChatBanned(id string, login string) (bool, error)
+	// Whether some registered user is shown in chat under this name, so that
+	// anonymous users can't pretend to be them.
+	IsNameRegistered(name string) (bool, error)
 }
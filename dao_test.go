@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestStreamTokenRotation(t *testing.T) {
+	db := testDB(t)
+	user, err := db.NewUser("test", "test@example.com", []byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.ActivateUser(user.ID, user.ActivationToken); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.StartStream("test", user.StreamToken); err != nil {
+		t.Fatal(err)
+	}
+	// Nodes that have the stream cache the token, so it can't change while live.
+	if token, err := db.NewStreamToken(user.ID); err != ErrStreamActive || token != "" {
+		t.Fatal(token, err)
+	}
+	if token, err := db.NewStreamToken(user.ID + 1); err != ErrUserNotExist || token != "" {
+		t.Fatal(token, err)
+	}
+	if err = db.StopStream("test"); err != nil {
+		t.Fatal(err)
+	}
+	token, err := db.NewStreamToken(user.ID)
+	if err != nil || token == "" || token == user.StreamToken {
+		t.Fatal(token, err)
+	}
+	if err = db.StartStream("test", user.StreamToken); err != ErrInvalidToken {
+		t.Fatal(err)
+	}
+	if err = db.StartStream("test", token); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPasswordHash(t *testing.T) {
+	hash, err := HashPassword([]byte("password"))
+	if err != nil || bytes.Contains(hash, []byte("password")) {
+		t.Fatal(string(hash), err)
+	}
+	if err = CheckPassword(hash, []byte("password")); err != nil {
+		t.Fatal(err)
+	}
+	if err = CheckPassword(hash, []byte("passwore")); err != ErrUserNotExist {
+		t.Fatal(err)
+	}
+	if err = CheckPassword(nil, []byte("password")); err != ErrUserNotExist {
+		t.Fatal(err)
+	}
+	if _, err = HashPassword([]byte("abc")); err != ErrInvalidPassword {
+		t.Fatal(err)
+	}
+	db := testDB(t)
+	user, err := db.NewUser("test", "test@example.com", []byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, err := db.GetUserID("test", []byte("password")); err != nil || id != user.ID {
+		t.Fatal(id, err)
+	}
+	if _, err := db.GetUserID("test", []byte("passwore")); err != ErrUserNotExist {
+		t.Fatal(err)
+	}
+	if _, err := db.GetUserID("nobody", []byte("password")); err != ErrUserNotExist {
+		t.Fatal(err)
+	}
+}
+
+func TestLoginByEmail(t *testing.T) {
+	db := testDB(t)
+	alice, err := db.NewUser("alice", "alice@example.com", []byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Someone whose login is another user's email.
+	bob, err := db.NewUser("alice@example.com", "bob@example.com", []byte("password2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		login    string
+		password string
+		id       int64
+	}{
+		{"alice", "password", alice.ID},
+		{"bob@example.com", "password2", bob.ID},
+		// Logins take precedence over emails.
+		{"alice@example.com", "password2", bob.ID},
+		{"alice@example.com", "password", 0},
+		{"bob@example.com", "password", 0},
+	} {
+		id, err := db.GetUserID(c.login, []byte(c.password))
+		if c.id == 0 && err != ErrUserNotExist {
+			t.Fatalf("%s, %s: %v", c.login, c.password, err)
+		} else if c.id != 0 && (err != nil || id != c.id) {
+			t.Fatalf("%s, %s: %d, %v", c.login, c.password, id, err)
+		}
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+	db := testDB(t)
+	user, err := db.NewUser("test", "test@example.com", []byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.ActivateUser(user.ID, user.ActivationToken); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.AppendChatMessage("test", ChatMessage{id: 1, name: "bob", text: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.StartStream("test", user.StreamToken); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.DeleteUser(user.ID, []byte("passwore")); err != ErrUserNotExist {
+		t.Fatal(err)
+	}
+	if err = db.DeleteUser(user.ID, []byte("password")); err != ErrStreamActive {
+		t.Fatal(err)
+	}
+	if err = db.StopStream("test"); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.DeleteUser(user.ID, []byte("password")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.GetUserID("test", []byte("password")); err != ErrUserNotExist {
+		t.Fatal(err)
+	}
+	// Someone else can take the login without inheriting anything.
+	if _, err = db.NewUser("test", "test@example.com", []byte("password")); err != nil {
+		t.Fatal(err)
+	}
+	if msgs, err := db.RecentChatMessages("test", 10); err != nil || len(msgs) != 0 {
+		t.Fatal(msgs, err)
+	}
+}
+
+func TestFollows(t *testing.T) {
+	db := testDB(t)
+	var users []*UserData
+	for _, login := range []string{"alice", "bob", "carol"} {
+		user, err := db.NewUser(login, login+"@example.com", []byte("password"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		users = append(users, user)
+	}
+	alice, bob, carol := users[0].ID, users[1].ID, users[2].ID
+	if err := db.Follow(alice, alice); err != ErrFollowSelf {
+		t.Fatal(err)
+	}
+	if err := db.Follow(alice, carol+1); err != ErrUserNotExist {
+		t.Fatal(err)
+	}
+	// Following twice is the same as following once.
+	for _, follower := range []int64{bob, carol, bob} {
+		if err := db.Follow(follower, alice); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if r, err := db.Followers(alice); err != nil || len(r) != 2 || r[0].Login != "bob" || r[1].Login != "carol" {
+		t.Fatal(r, err)
+	}
+	if r, err := db.Following(bob); err != nil || len(r) != 1 || r[0].ID != alice {
+		t.Fatal(r, err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := db.Unfollow(bob, alice); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if r, err := db.Followers(alice); err != nil || len(r) != 1 || r[0].Login != "carol" {
+		t.Fatal(r, err)
+	}
+	if err := db.DeleteUser(carol, []byte("password")); err != nil {
+		t.Fatal(err)
+	}
+	if r, err := db.Followers(alice); err != nil || len(r) != 0 {
+		t.Fatal(r, err)
+	}
+}
+
+func TestRenewActivationToken(t *testing.T) {
+	db := testDB(t)
+	user, err := db.NewUser("test", "test@example.com", []byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := db.RenewActivationToken(user.ID)
+	if err != nil || token == "" || token == user.ActivationToken {
+		t.Fatal(token, err)
+	}
+	if err = db.ActivateUser(user.ID, user.ActivationToken); err != ErrInvalidToken {
+		t.Fatal(err)
+	}
+	if err = db.ActivateUser(user.ID, token); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.RenewActivationToken(user.ID); err != ErrAlreadyActive {
+		t.Fatal(err)
+	}
+	if _, err = db.RenewActivationToken(user.ID + 1); err != ErrUserNotExist {
+		t.Fatal(err)
+	}
+}
+
+func TestActivateUser(t *testing.T) {
+	db := testDB(t)
+	alice, err := db.NewUser("alice", "alice@example.com", []byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := db.NewUser("bob", "bob@example.com", []byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name  string
+		id    int64
+		token string
+		err   error
+	}{
+		{"unknown user", bob.ID + 1, alice.ActivationToken, ErrUserNotExist},
+		{"token of another user", bob.ID, alice.ActivationToken, ErrInvalidToken},
+		{"empty token", alice.ID, "", ErrInvalidToken},
+		{"correct token", alice.ID, alice.ActivationToken, nil},
+		{"already active", alice.ID, alice.ActivationToken, nil},
+		{"already active, wrong token", alice.ID, "xyz", nil},
+	} {
+		if err := db.ActivateUser(c.id, c.token); err != c.err {
+			t.Errorf("%s: %v", c.name, err)
+		}
+	}
+}
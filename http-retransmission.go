@@ -4,8 +4,8 @@
 //     Accepted input: valid WebM split into arbitrarily many requests in absolutely
 //     any way. Multiple files can be concatenated into a single stream as long as they
 //     contain exactly the same tracks (i.e. their number, codecs, and dimensions.
-//     Otherwise any connected decoders will error and have to restart. Changing,
-//     for example, bitrate or tags is fine.)
+//     Otherwise the headers are sent to viewers again, and decoders that cannot handle
+//     that will error and have to restart. Changing, for example, bitrate or tags is fine.)
 //
 // GET /stream/<name>
 //     Receive a published WebM stream. Note that the server makes no attempt
@@ -19,8 +19,28 @@
 //
 //        * `SetName(string)`: assign a (unique) name to this client. This is required to...
 //        * `SendMessage(string)`: broadcast a simple text message to all viewers.
+//        * `Whisper(user string, text string)`: send a message to one user only.
+//        * `RequestUserList()`: ask for a `Chat.UserList`.
+//        * `SetTyping(bool)`: show others that this user is writing something.
 //        * `RequestHistory()`: ask the server to emit notifications containing the last
 //          few broadcasted text messages.
+//        * `DeleteMessage(id int)`: remove a message from history. Only for the streamer.
+//        * `Kick(login string)`: disconnect a logged-in user. Only for the streamer.
+//        * `Ban(login string)`: same, but also prevent them from reconnecting, even
+//          to later broadcasts.
+//        * `Unban(login string)`: undo `Ban`. Only for the streamer.
+//        * `SetSlowMode(seconds int)`: limit how often everyone can send messages.
+//          Only for the streamer, who is exempt from it. 0 turns it off.
+//
+//     Errors have these codes (see `ChatError*`) where applicable:
+//
+//        * 1: `SetName` first.
+//        * 2: rate limit or slow mode; try again later.
+//        * 3: banned.
+//        * 4: the message is empty or too long.
+//        * 5: only the streamer can do that.
+//        * 6: the name is taken.
+//        * 7: the message contains blocked words.
 //
 //     TODO Methods of `Stream`.
 //
@@ -28,7 +48,28 @@
 //
 //        * `Chat.AcquiredName(user string)`: upon a successful `SetName`.
 //          May be emitted automatically at the start of a connection if already logged in.
-//        * `Chat.Message(user string, text string)`: a broadcasted text message.
+//        * `Chat.NameTaken(user string)`: a logged-in user has joined under the name this
+//          anonymous client was using, so it no longer has one.
+//        * `Chat.Emotes(emotes map[string]string)`: upon connecting, if there are any.
+//          Messages may contain ":name:", which should be shown as an image with this URL.
+//        * `Chat.NameExpired(user string)`: this anonymous client has not sent anything
+//          for too long, so its name was given up. Call `SetName` again to get it back.
+//        * `Chat.Message(user string, text string, login string, action bool, id int, time int)`:
+//          a broadcasted text message. `action` is set for "/me ..." messages (the "/me"
+//          is removed.) `time` is in milliseconds since the Unix epoch.
+//        * `Chat.MessageDeleted(id int)`: hide a message sent earlier.
+//        * `Chat.Whisper(user string, login string, to string, text string)`: a private
+//          message, delivered to both the recipient and the sender.
+//        * `Chat.UserJoined(user string, login string)`, `Chat.UserLeft(user string, login string)`:
+//          a logged-in user has connected/disconnected.
+//        * `Stream.Offline()`: the broadcast has ended; the connection will close shortly.
+//        * `Chat.SlowMode(seconds int)`: upon connecting (if nonzero) and after each change.
+//        * `Chat.UserList(users [][user string, login string])`: everyone who has a name.
+//        * `Chat.Typing(user string, login string, typing bool)`: see `SetTyping`.
+//          Automatically reset to `false` if the user disconnects.
+//        * `Chat.UserBanned(login string)`: someone has been banned by the streamer.
+//        * `Chat.Full()`: sent instead of everything else if there are too many users.
+//        * `Chat.Banned()`: sent instead of everything else if this user is banned.
 //
 package main
 
@@ -38,6 +79,7 @@ import (
 	"net/http"
 	"strings"
 	"sync"
+	"time"
 )
 
 type RetransmissionHandler struct {
@@ -53,6 +95,7 @@ func NewRetransmissionHandler(c *Context) *RetransmissionHandler {
 	ctx.OnStreamClose = func(id string) {
 		ctx.chatLock.Lock()
 		if chat, ok := ctx.chats[id]; ok {
+			chat.NewStreamOffline()
 			chat.Close()
 			delete(ctx.chats, id)
 		}
@@ -61,6 +104,9 @@ func NewRetransmissionHandler(c *Context) *RetransmissionHandler {
 			log.Println("Error stopping the stream: ", err)
 		}
 	}
+	ctx.OnStreamError = func(id string, err error) {
+		log.Println("Stream", id, "is malformed: ", err)
+	}
 	ctx.OnStreamTrackInfo = func(id string, info *StreamTrackInfo) {
 		if err := ctx.SetStreamTrackInfo(id, info); err != nil {
 			log.Println("Error setting stream metadata: ", err)
@@ -98,7 +144,7 @@ func (ctx *RetransmissionHandler) watch(w http.ResponseWriter, r *http.Request,
 		return RenderError(w, http.StatusBadRequest, "Send WebMs here, watch using the other links.")
 	}
 
-	stream, ok := ctx.Readable(id)
+	stream, ok := ctx.ReadableLive(id)
 	if !ok {
 		switch server, err := ctx.GetStreamServer(id); err {
 		case ErrStreamNotHere:
@@ -125,15 +171,24 @@ func (ctx *RetransmissionHandler) watch(w http.ResponseWriter, r *http.Request,
 		if err != nil && err != ErrUserNotExist {
 			return err
 		}
+		owner := false
+		if auth != nil {
+			if meta, err := ctx.GetStreamMetadata(id); err == nil {
+				owner = meta.OwnerID == auth.ID
+			}
+		}
 		websocket.Handler(func(ws *websocket.Conn) {
 			ctx.chatLock.Lock()
 			chat, ok := ctx.chats[id]
 			if !ok {
-				chat = NewChat(20)
+				chat = NewChat(20, id, ctx.Database)
+				chat.RateLimit = 5
+				chat.NameExpiry = 30 * time.Minute
+				chat.Emotes = ctx.Emotes
 				ctx.chats[id] = chat
 			}
 			ctx.chatLock.Unlock()
-			chat.RunRPC(ws, auth)
+			chat.RunRPC(ws, auth, owner)
 		}).ServeHTTP(w, r)
 		return nil
 	}
@@ -145,21 +200,29 @@ func (ctx *RetransmissionHandler) watch(w http.ResponseWriter, r *http.Request,
 	w.WriteHeader(http.StatusOK)
 	f, flushable := w.(http.Flusher)
 
+	// Not closed here, as the stream may have already done that to get rid of us.
 	ch := make(chan []byte, 240)
-	defer close(ch)
 
-	stream.Connect(ch, false)
-	defer stream.Disconnect(ch)
+	// (The request's context is canceled when this handler returns or the client
+	// goes away, even if the stream is idle and there is nothing to write.)
+	stream.ConnectContext(r.Context(), ch, false, ^uint64(0))
 
-	for chunk := range ch {
-		if _, err := w.Write(chunk); err != nil || stream.Closed {
-			break
-		}
-		if flushable {
-			f.Flush()
+	for {
+		select {
+		case chunk := <-ch:
+			if len(chunk) == 0 {
+				return nil
+			}
+			if _, err := w.Write(chunk); err != nil || stream.Closed {
+				return nil
+			}
+			if flushable {
+				f.Flush()
+			}
+		case <-r.Context().Done():
+			return nil
 		}
 	}
-	return nil
 }
 
 func (ctx *RetransmissionHandler) stream(w http.ResponseWriter, r *http.Request, id string) error {
@@ -175,24 +238,27 @@ func (ctx *RetransmissionHandler) stream(w http.ResponseWriter, r *http.Request,
 	case nil:
 	}
 
-	stream, ok := ctx.Writable(id)
+	// The token has already been checked, so this is the same broadcaster, probably
+	// reconnecting before the old connection has timed out.
+	stream, evicted, ok := ctx.WritableForce(id)
 	if !ok {
-		return RenderError(w, http.StatusForbidden, "Stream ID already taken.")
-	}
-	defer stream.Close()
-
-	buffer := [16384]byte{}
-	for {
-		n, err := r.Body.Read(buffer[:])
-		if n != 0 {
-			if _, err := stream.Write(buffer[:n]); err != nil {
-				stream.Reset()
-				return RenderError(w, http.StatusBadRequest, err.Error())
+		if ctx.Full() {
+			if err := ctx.StopStream(id); err != nil {
+				return err
 			}
+			return RenderError(w, http.StatusServiceUnavailable, "Too many streams on this server.")
 		}
-		if err != nil {
-			w.WriteHeader(http.StatusNoContent)
-			return nil
-		}
+		return RenderError(w, http.StatusForbidden, "Stream ID already taken.")
 	}
+	defer func() {
+		select {
+		case <-evicted:
+			// The stream now belongs to another connection.
+		default:
+			stream.Close()
+		}
+	}()
+
+	stream.ingest(w, r, evicted, http.StatusNoContent)
+	return nil
 }
@@ -26,10 +26,16 @@
 // GET /user/logout
 //
 // POST /user/new-token
+// POST /user/set-stream-name
+// POST /user/set-stream-panel
+// POST /user/del-stream-panel
+//     Redirect back, or, if the request accepts `application/json` (i.e. it is an XHR),
+//     reply with an object: `{"token": string}` for `new-token`, empty for the rest.
 //
 package main
 
 import (
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
@@ -52,7 +58,21 @@ func redirectBack(w http.ResponseWriter, r *http.Request, fallback string, code
 	return nil
 }
 
+// Whether the client wants data rather than a page, see `RenderJSON`.
+func acceptsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// The address of the client, for the audit log. (Proxies are not taken into account.)
+func remoteIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
 func (ctx UIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) error {
+	w = ConditionalGET(w, r)
 	user, err := ctx.GetAuthInfo(r)
 	if err != nil && err != ErrUserNotExist {
 		return err
@@ -94,7 +114,7 @@ func (ctx UIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) error {
 
 		recs, err := ctx.GetRecordings(id)
 		if err == nil {
-			err = Render(w, http.StatusOK, Recordings{id, user != nil && recs.OwnerID == user.ID, user, recs})
+			err = RenderStream(w, http.StatusOK, Recordings{id, user != nil && recs.OwnerID == user.ID, user, recs})
 		} else if err == ErrStreamNotExist {
 			err = RenderError(w, http.StatusNotFound, "Invalid stream name.")
 		}
@@ -131,12 +151,15 @@ func (ctx UIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) error {
 
 			_, err = ctx.SetUserData(user.ID,
 				r.FormValue("displayname"), r.FormValue("username"), r.FormValue("email"),
-				r.FormValue("about"), []byte(r.FormValue("password")),
+				r.FormValue("about"), []byte(r.FormValue("password")), remoteIP(r),
 			)
+			if avatar := strings.TrimSpace(r.FormValue("avatar")); err == nil && avatar != user.AvatarURL {
+				err = ctx.SetUserAvatar(user.ID, avatar)
+			}
 			switch err {
 			default:
 				return err
-			case ErrInvalidUsername, ErrInvalidPassword, ErrInvalidEmail, ErrUserNotUnique:
+			case ErrInvalidUsername, ErrInvalidPassword, ErrInvalidEmail, ErrUserNotUnique, ErrInvalidURL:
 				return RenderError(w, http.StatusBadRequest, err.Error())
 			case ErrStreamActive:
 				return RenderError(w, http.StatusForbidden, "Stop streaming first.")
@@ -216,7 +239,7 @@ func (ctx UIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) error {
 				if err != nil {
 					return RenderError(w, http.StatusBadRequest, "Invalid user ID.")
 				}
-				err = ctx.ResetUserStep2(uid, r.FormValue("token"), []byte(r.FormValue("password")))
+				err = ctx.ResetUserStep2(uid, r.FormValue("token"), []byte(r.FormValue("password")), remoteIP(r))
 				if err == nil {
 					err = ctx.SetAuthInfo(w, uid)
 				}
@@ -225,6 +248,8 @@ func (ctx UIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) error {
 					return err
 				case ErrInvalidPassword:
 					return RenderError(w, http.StatusBadRequest, err.Error())
+				case ErrInvalidToken:
+					return RenderError(w, http.StatusBadRequest, "Invalid or expired token.")
 				case ErrUserNotExist, nil:
 					http.Redirect(w, r, "/user/", http.StatusSeeOther)
 				}
@@ -254,7 +279,7 @@ func (ctx UIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) error {
 			return RenderError(w, http.StatusBadRequest, "Invalid user ID.")
 		}
 		err = ctx.ActivateUser(uid, r.FormValue("token"))
-		if err == ErrInvalidToken {
+		if err == ErrInvalidToken || err == ErrUserNotExist {
 			return RenderError(w, http.StatusBadRequest, "Invalid activation token.")
 		}
 		if err != nil {
@@ -270,12 +295,25 @@ func (ctx UIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) error {
 			return RenderError(w, http.StatusForbidden, "You own no streams.")
 		}
 
+		result := map[string]string{}
 		switch r.URL.Path {
 		case "/user/new-token":
-			err = ctx.NewStreamToken(user.ID)
+			token, err := ctx.NewStreamToken(user.ID)
+			if err == ErrStreamActive {
+				return RenderError(w, http.StatusForbidden, "Stop streaming first.")
+			}
+			if err != nil {
+				return err
+			}
+			result["token"] = token
 
 		case "/user/set-stream-name":
 			err = ctx.SetStreamName(user.ID, r.FormValue("value"), r.FormValue("nsfw") == "yes")
+			if err == nil {
+				if err = ctx.SetStreamCategory(user.ID, strings.TrimSpace(r.FormValue("category"))); err == ErrInvalidCategory {
+					return RenderError(w, http.StatusBadRequest, err.Error())
+				}
+			}
 
 		case "/user/set-stream-panel":
 			// TODO image
@@ -298,6 +336,9 @@ func (ctx UIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) error {
 		}
 
 		if err == nil {
+			if acceptsJSON(r) {
+				return RenderJSON(w, http.StatusOK, result)
+			}
 			return redirectBack(w, r, "/user/", http.StatusSeeOther)
 		}
 		return err
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// An empty in-memory database, closed at the end of the test.
+func testDB(t *testing.T) *sqlDAO {
+	db, err := NewSQLDatabase("", "sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each connection to ":memory:" is a separate database.
+	db.(*sqlDAO).SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	return db.(*sqlDAO)
+}
+
+func testUI(t *testing.T) (*Context, *UserData) {
+	db := testDB(t)
+	user, err := db.NewUser("test", "test@example.com", []byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Context{Database: db, SecureKey: []byte("12345678901234567890123456789012")}, user
+}
+
+// A request made by `user` (if not nil).
+func testRequest(t *testing.T, ctx *Context, user *UserData, method string, path string) *http.Request {
+	r := httptest.NewRequest(method, path, nil)
+	if user != nil {
+		w := httptest.NewRecorder()
+		if err := ctx.SetAuthInfo(w, user.ID); err != nil {
+			t.Fatal(err)
+		}
+		for _, cookie := range w.Result().Cookies() {
+			r.AddCookie(cookie)
+		}
+	}
+	return r
+}
+
+func TestNewTokenJSON(t *testing.T) {
+	ctx, user := testUI(t)
+	ui := UnsafeHandler{NewUIHandler(ctx)}
+
+	w := httptest.NewRecorder()
+	ui.ServeHTTP(w, testRequest(t, ctx, user, "POST", "/user/new-token"))
+	if w.Code != http.StatusSeeOther {
+		t.Fatal("a form submission should be redirected back, got ", w.Code)
+	}
+
+	r := testRequest(t, ctx, user, "POST", "/user/new-token")
+	r.Header.Set("Accept", "application/json")
+	w = httptest.NewRecorder()
+	ui.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatal(w.Code, w.Header())
+	}
+	var result struct{ Token string }
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatal(err, w.Body.String())
+	}
+	if full, err := ctx.GetUserFull(user.ID); err != nil || result.Token == "" || result.Token != full.StreamToken {
+		t.Fatal("not the new token: ", w.Body.String())
+	}
+}
+
+func TestRecordingsStreamed(t *testing.T) {
+	ctx, user := testUI(t)
+	w := httptest.NewRecorder()
+	UnsafeHandler{NewUIHandler(ctx)}.ServeHTTP(w, testRequest(t, ctx, user, "GET", "/rec/test"))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Fatal(w.Code, w.Header())
+	}
+	// `RenderStream` cannot hash a page it has not generated yet.
+	if w.Header().Get("ETag") != "" {
+		t.Fatal("not streamed")
+	}
+	if body := w.Body.String(); !strings.Contains(body, "Disk space used") || !strings.Contains(body, "The archive is empty.") {
+		t.Fatal(body)
+	}
+}
@@ -1,12 +1,18 @@
 package main
 
 import (
+	"compress/gzip"
+	"context"
 	"flag"
 	_ "github.com/mattn/go-sqlite3"
 	"log"
 	"math/rand"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 )
 
@@ -44,12 +50,119 @@ func (ctx UnsafeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Compress responses if the client supports it. Not needed behind a reverse proxy
+// that does the same.
+type GzipHandler struct {
+	http.Handler
+}
+
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+// The `ETag` of a compressed response: it's a different sequence of bytes, so
+// a strong tag must differ from that of the uncompressed page.
+func gzipETag(tag string) string {
+	if strings.HasSuffix(tag, `"`) {
+		return tag[:len(tag)-1] + `-gzip"`
+	}
+	return tag
+}
+
+func (w *gzipResponseWriter) WriteHeader(code int) {
+	w.wroteHeader = true
+	w.Header().Del("Content-Length")
+	// (Also on 304s, which must have the same tag as the response they stand for.)
+	if tag := w.Header().Get("ETag"); tag != "" {
+		w.Header().Set("ETag", gzipETag(tag))
+	}
+	// these have no body, and an empty gzip stream is not empty.
+	if code != http.StatusNoContent && code != http.StatusNotModified {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *gzipResponseWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gz == nil {
+		return w.ResponseWriter.Write(data)
+	}
+	return w.gz.Write(data)
+}
+
+// Whether an `Accept-Encoding` header allows gzip, i.e. lists it (or `*`, unless
+// gzip itself is listed) with a non-zero quality.
+func acceptsGzip(header string) bool {
+	wildcard := false
+	for _, coding := range strings.Split(header, ",") {
+		params := strings.Split(coding, ";")
+		name := strings.TrimSpace(params[0])
+		if !strings.EqualFold(name, "gzip") && name != "*" {
+			continue
+		}
+		accept := true
+		for _, param := range params[1:] {
+			if param = strings.TrimSpace(param); strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				accept = err == nil && q > 0
+			}
+		}
+		if name != "*" {
+			return accept
+		}
+		wildcard = accept
+	}
+	return wildcard
+}
+
+func (ctx GzipHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Vary", "Accept-Encoding")
+	if !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+		ctx.Handler.ServeHTTP(w, r)
+		return
+	}
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		// `ConditionalGET` compares these to the tags of uncompressed pages, so only
+		// those that the client got from `gzipETag` are left.
+		var tags []string
+		for _, tag := range strings.Split(match, ",") {
+			if tag = strings.TrimSpace(tag); tag == "*" {
+				tags = append(tags, tag)
+			} else if strings.HasSuffix(tag, `-gzip"`) {
+				tags = append(tags, tag[:len(tag)-len(`-gzip"`)]+`"`)
+			}
+		}
+		r = r.Clone(r.Context())
+		r.Header.Set("If-None-Match", strings.Join(tags, ", "))
+	}
+	gw := &gzipResponseWriter{ResponseWriter: w}
+	ctx.Handler.ServeHTTP(gw, r)
+	if gw.gz != nil {
+		gw.gz.Close()
+	}
+}
+
 func main() {
 	rand.Seed(time.Now().UTC().UnixNano())
 	bind := flag.String("bind", ":8000", "The network ([ip]:port) to bind on.")
 	addr := flag.String("addr", "", "The public address (host[:port]) of this node.")
+	production := flag.Bool("production", false, "Do not reload templates when they change.")
+	compress := flag.Bool("gzip", false, "Compress HTML pages.")
+	secure := flag.Bool("security-headers", false, "Send Content-Security-Policy and friends with each page.")
+	maxStreams := flag.Int("max-streams", 0, "How many streams this node accepts at once (0 = no limit).")
+	maxDuration := flag.Duration("max-stream-duration", 0, "Stop streams that have been live for this long (0 = no limit).")
 	ephemeral := flag.Bool("ephemeral", false, "Use a process-local in-memory userless database. Can only be enabled in joint mode.")
 	flag.Parse()
+	templates.Static = *production
+	if *secure {
+		templates.Headers = SecurityHeaders
+	}
 
 	if *ephemeral && *addr != "" {
 		log.Fatal("-ephemeral cannot be used with -addr. Running as a part of a cluster requires coordination through a database.")
@@ -67,9 +180,31 @@ func main() {
 		}
 	}
 
+	streams := NewRetransmissionHandler(&ctx)
+	streams.MaxStreams = *maxStreams
+	streams.MaxStreamDuration = *maxDuration
+	go func() {
+		// Mark the streams on this node as offline before exiting so that they
+		// can be restarted elsewhere without waiting for anything to time out.
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		c, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := streams.Shutdown(c); err != nil {
+			log.Println("Error stopping streams: ", err)
+		}
+		cancel()
+		ctx.Close()
+		os.Exit(0)
+	}()
+
 	mux := http.NewServeMux()
 	mux.Handle("/static/", http.FileServer(disallowDirectoryListing(".")))
-	mux.Handle("/stream/", UnsafeHandler{NewRetransmissionHandler(&ctx)})
-	mux.Handle("/", UnsafeHandler{NewUIHandler(&ctx)})
+	mux.Handle("/stream/", UnsafeHandler{streams})
+	var ui http.Handler = UnsafeHandler{NewUIHandler(&ctx)}
+	if *compress {
+		ui = GzipHandler{ui}
+	}
+	mux.Handle("/", ui)
 	log.Fatal(http.ListenAndServe(*bind, mux))
 }
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGzipHandler(t *testing.T) {
+	page := strings.Repeat("<p>Hello, World!</p>", 100)
+	// Same as what `UIHandler` and `Render` do.
+	handler := GzipHandler{http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w = ConditionalGET(w, r)
+		w.Header().Set("ETag", `"abc"`)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(page))
+	})}
+	get := func(encoding string, match string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", encoding)
+		if match != "" {
+			r.Header.Set("If-None-Match", match)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("gzip, deflate", "")
+	if w.Header().Get("Content-Encoding") != "gzip" || w.Header().Get("Vary") != "Accept-Encoding" {
+		t.Fatal(w.Header())
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, err := ioutil.ReadAll(gz); err != nil || string(body) != page {
+		t.Fatal(string(body), err)
+	}
+	tag := w.Header().Get("ETag")
+	if tag != `"abc-gzip"` {
+		t.Fatal("the tag of a compressed response should differ from the page's: ", tag)
+	}
+	if w = get("gzip", tag); w.Code != http.StatusNotModified || w.Body.Len() != 0 || w.Header().Get("ETag") != tag {
+		t.Fatal(w.Code, w.Header(), w.Body.Len())
+	}
+	// The client has the uncompressed page, but it can't be used in place of this one.
+	if w = get("gzip", `"abc"`); w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatal(w.Code, w.Header())
+	}
+	if w = get("identity", tag); w.Code != http.StatusOK || w.Body.String() != page {
+		t.Fatal(w.Code, w.Header())
+	}
+
+	w = get("identity", "")
+	if w.Header().Get("Content-Encoding") != "" || w.Header().Get("Vary") != "Accept-Encoding" || w.Body.String() != page {
+		t.Fatal(w.Header())
+	}
+	if tag := w.Header().Get("ETag"); tag != `"abc"` {
+		t.Fatal("the tag of an uncompressed response should stay strong: ", tag)
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	for header, expect := range map[string]bool{
+		"":                  false,
+		"gzip":              true,
+		"deflate, GZIP":     true,
+		"gzip;q=0.5":        true,
+		"gzip;q=0":          false,
+		"gzip; q=0.0, br":   false,
+		"*":                 true,
+		"*;q=0":             false,
+		"gzip;q=0, *":       false,
+		"*, gzip;q=0":       false,
+		"identity, *;q=0.1": true,
+		"x-gzip, identity":  false,
+		"br;q=1.0, deflate": false,
+	} {
+		if acceptsGzip(header) != expect {
+			t.Errorf("%q: expected %v", header, expect)
+		}
+	}
+}
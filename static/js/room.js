@@ -166,6 +166,9 @@ let withRPC = rpc => ({
 
         rpc.on(RPC.STATE_OPEN,   autoscroll(_ => e.classList.add('online')));
         rpc.on(RPC.STATE_CLOSED, autoscroll(_ => e.classList.remove('online')));
+        let emotes = {};
+        let escapeAttr = s => s.replace(/&/g, '&amp;').replace(/"/g, '&quot;');
+        rpc.on('Chat.Emotes', es => emotes = es);
         rpc.on('Chat.Message', autoscroll((name, text, login) => {
             let h = parseInt(sha1(`${login}\n${name}`).slice(32), 16);
             let m = document.createElement('li');
@@ -176,6 +179,8 @@ let withRPC = rpc => ({
             nameSpan.textContent = name;
             nameSpan.setAttribute('title', login);
             textSpan.textContent = text;
+            textSpan.innerHTML = textSpan.innerHTML.replace(/:([^:\s]+):/g, (m, name) =>
+                emotes.hasOwnProperty(name) ? `<img class="emote" alt="${escapeAttr(name)}" src="${escapeAttr(emotes[name])}">` : m);
             textSpan.innerHTML = textSpan.innerHTML.replace($.emoji.re, $.emoji.wrap);
             m.appendChild(nameSpan);
             m.appendChild(textSpan);
@@ -185,6 +190,7 @@ let withRPC = rpc => ({
             e.classList.add('logged-in');
             e.querySelector('.input-form textarea').select();
         }));
+        rpc.on('Chat.NameExpired', autoscroll(name => e.classList.remove('logged-in')));
     },
 });
 
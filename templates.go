@@ -2,20 +2,39 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"html/template"
 	"net/http"
 	"os"
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"strings"
+	"sync"
 	"time"
 )
 
 type templateSet struct {
 	root  string
+	lock  sync.Mutex
 	data  *template.Template
 	mtime time.Time
+	// Parse the templates once and never check whether they have changed.
+	Static bool
+	// Added to every page, e.g. `SecurityHeaders`.
+	Headers map[string]string
+}
+
+// A reasonable default; the error page has an inline script and a web font,
+// avatars can be anywhere, and streams are played from blobs.
+var SecurityHeaders = map[string]string{
+	"Content-Security-Policy": "default-src 'self'; img-src * data:; media-src 'self' blob:; " +
+		"connect-src 'self' ws: wss:; script-src 'self' 'unsafe-inline'; " +
+		"style-src 'self' 'unsafe-inline' https://fonts.googleapis.com; font-src 'self' https://fonts.gstatic.com",
+	"X-Content-Type-Options": "nosniff",
+	"X-Frame-Options":        "SAMEORIGIN",
 }
 
 type viewmodel interface {
@@ -36,40 +55,178 @@ var templateFuncs = template.FuncMap{
 		}
 		return rv.FieldByName(name).IsValid()
 	},
+	// "2h 14m", "5m 3s", "12s".
+	"duration": func(d time.Duration) string {
+		d = d / time.Second * time.Second
+		switch {
+		case d >= time.Hour:
+			return fmt.Sprintf("%dh %dm", d/time.Hour, d%time.Hour/time.Minute)
+		case d >= time.Minute:
+			return fmt.Sprintf("%dm %ds", d/time.Minute, d%time.Minute/time.Second)
+		}
+		return fmt.Sprintf("%ds", d/time.Second)
+	},
+	"humanBytes": func(n int64) string {
+		return FileSize(n).String()
+	},
+	// "1.5 Mbps", for `Broadcast.BitrateBPS`.
+	"bitrate": func(bps float64) string {
+		switch {
+		case bps >= 1e6:
+			return fmt.Sprintf("%.1f Mbps", bps/1e6)
+		case bps >= 1e3:
+			return fmt.Sprintf("%.1f Kbps", bps/1e3)
+		}
+		return fmt.Sprintf("%.0f bps", bps)
+	},
+	// "3 minutes ago", "in 2 hours".
+	"relTime": func(t time.Time) string {
+		d, format := time.Since(t), "%d %s ago"
+		if d < 0 {
+			d, format = -d, "in %d %s"
+		}
+		n, unit := int64(d/time.Second), "second"
+		for _, u := range []struct {
+			size time.Duration
+			name string
+		}{{time.Minute, "minute"}, {time.Hour, "hour"}, {24 * time.Hour, "day"}} {
+			if d >= u.size {
+				n, unit = int64(d/u.size), u.name
+			}
+		}
+		if n < 5 && unit == "second" {
+			return "just now"
+		}
+		if n != 1 {
+			unit += "s"
+		}
+		return fmt.Sprintf(format, n, unit)
+	},
 }
 
 var htmlInterElementWhitespace = regexp.MustCompile(">\\s+<")
 
-func (ts *templateSet) Render(w http.ResponseWriter, code int, vm viewmodel) error {
-	name := vm.TemplateFile()
+func (ts *templateSet) get(name string) (*template.Template, error) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	if ts.data != nil && ts.Static {
+		return ts.data, nil
+	}
 	stat, err := os.Stat(filepath.Join(ts.root, name))
 	if ts.data == nil || (err == nil && stat.ModTime().After(ts.mtime)) {
-		ts.data, err = template.New(ts.root).Funcs(templateFuncs).ParseGlob(filepath.Join(ts.root, "*"))
+		data, err := template.New(ts.root).Funcs(templateFuncs).ParseGlob(filepath.Join(ts.root, "*"))
 		if err != nil {
-			return err
+			return nil, err
 		}
-		ts.mtime = time.Now()
+		ts.data, ts.mtime = data, time.Now()
+	}
+	return ts.data, nil
+}
+
+func (ts *templateSet) setHeaders(w http.ResponseWriter) {
+	for k, v := range ts.Headers {
+		w.Header().Set(k, v)
 	}
-	if t := ts.data.Lookup(name); t != nil {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+}
+
+func (ts *templateSet) Render(w http.ResponseWriter, code int, vm viewmodel) error {
+	name := vm.TemplateFile()
+	data, err := ts.get(name)
+	if err != nil {
+		return err
+	}
+	if t := data.Lookup(name); t != nil {
 		buf := &bytes.Buffer{}
 		if err = t.Execute(buf, vm); err != nil {
 			return err
 		}
-		w.Header().Set("Content-Type", "text/html; encoding=utf-8")
+		page := htmlInterElementWhitespace.ReplaceAll(buf.Bytes(), []byte("> <"))
+		hash := fnv.New64a()
+		hash.Write(page)
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, hash.Sum64()))
+		ts.setHeaders(w)
 		w.WriteHeader(code)
-		w.Write(htmlInterElementWhitespace.ReplaceAll(buf.Bytes(), []byte("> <")))
+		w.Write(page)
 		return nil
 	}
 	return fmt.Errorf("template not found: %s", name)
 }
 
-var Render = (&templateSet{root: "templates"}).Render
+// Same as `Render`, but write the page as it is generated instead of buffering it.
+// Uses less memory for large pages; however, if an error occurs midway, the status
+// code has already been sent and the client gets a truncated page. Whitespace is
+// not collapsed and there is no `ETag`.
+func (ts *templateSet) RenderStream(w http.ResponseWriter, code int, vm viewmodel) error {
+	name := vm.TemplateFile()
+	data, err := ts.get(name)
+	if err != nil {
+		return err
+	}
+	t := data.Lookup(name)
+	if t == nil {
+		return fmt.Errorf("template not found: %s", name)
+	}
+	ts.setHeaders(w)
+	w.WriteHeader(code)
+	return t.Execute(w, vm)
+}
+
+// Replaces a 200 response with a 304 if it has an `ETag` (set by `Render`) that the client
+// already has a copy of.
+type conditionalResponseWriter struct {
+	http.ResponseWriter
+	match       []string
+	notModified bool
+}
+
+func (w *conditionalResponseWriter) WriteHeader(code int) {
+	if tag := w.Header().Get("ETag"); code == http.StatusOK && tag != "" {
+		for _, m := range w.match {
+			if m = strings.TrimSpace(m); m == tag || m == "W/"+tag || m == "*" {
+				w.notModified = true
+				code = http.StatusNotModified
+				w.Header().Del("Content-Type")
+				break
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *conditionalResponseWriter) Write(data []byte) (int, error) {
+	if w.notModified {
+		return len(data), nil
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// Make pages rendered in response to a request with `If-None-Match` conditional.
+func ConditionalGET(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	if match := r.Header.Get("If-None-Match"); r.Method == "GET" && match != "" {
+		return &conditionalResponseWriter{ResponseWriter: w, match: strings.Split(match, ",")}
+	}
+	return w
+}
+
+var templates = &templateSet{root: "templates"}
+var Render = templates.Render
+var RenderStream = templates.RenderStream
 
 type ErrorTemplate struct {
 	Code    int
 	Message string
 }
 
+// Replacements for the default texts of error pages, by status code.
+var errorTexts = make(map[int][2]string)
+
+// Change the message and comment shown for a status code. An empty string keeps
+// the default. Not safe to call while serving requests.
+func RegisterErrorText(code int, message string, comment string) {
+	errorTexts[code] = [2]string{message, comment}
+}
+
 func (_ ErrorTemplate) TemplateFile() string {
 	return "error.html"
 }
@@ -78,6 +235,9 @@ func (e ErrorTemplate) DisplayMessage() string {
 	if e.Message != "" {
 		return e.Message
 	}
+	if text := errorTexts[e.Code][0]; text != "" {
+		return text
+	}
 
 	switch e.Code {
 	case 403:
@@ -96,6 +256,9 @@ func (e ErrorTemplate) DisplayMessage() string {
 }
 
 func (e ErrorTemplate) DisplayComment() string {
+	if text := errorTexts[e.Code][1]; text != "" {
+		return text
+	}
 	switch e.Code {
 	case 403:
 		return "you're just a dirty hacker, aren't you?"
@@ -115,6 +278,18 @@ func RenderError(w http.ResponseWriter, code int, message string) error {
 	return Render(w, code, ErrorTemplate{code, message})
 }
 
+// Respond to an XHR with some data instead of a page.
+func RenderJSON(w http.ResponseWriter, code int, v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return RenderError(w, http.StatusInternalServerError, "")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(buf)
+	return nil
+}
+
 func RenderInvalidMethod(w http.ResponseWriter, methods string) error {
 	w.Header().Set("Allow", methods)
 	return RenderError(w, http.StatusMethodNotAllowed, "")
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testPage struct{ X interface{} }
+
+func (testPage) TemplateFile() string { return "test.html" }
+
+// A `templateSet` of a single "test.html" in a temporary directory.
+func testTemplates(t *testing.T, text string) (*templateSet, string) {
+	root := t.TempDir()
+	path := filepath.Join(root, "test.html")
+	if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return &templateSet{root: root}, path
+}
+
+func TestTemplatesStatic(t *testing.T) {
+	for _, static := range []bool{false, true} {
+		ts, path := testTemplates(t, "one")
+		ts.Static = static
+		w := httptest.NewRecorder()
+		if err := ts.Render(w, 200, testPage{}); err != nil || w.Body.String() != "one" {
+			t.Fatal(static, err, w.Body.String())
+		}
+		if err := os.WriteFile(path, []byte("two"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// Make sure the change is seen even if the clock is coarse.
+		future := time.Now().Add(time.Hour)
+		if err := os.Chtimes(path, future, future); err != nil {
+			t.Fatal(err)
+		}
+		expect := map[bool]string{false: "two", true: "one"}[static]
+		w = httptest.NewRecorder()
+		if err := ts.Render(w, 200, testPage{}); err != nil || w.Body.String() != expect {
+			t.Fatal(static, err, w.Body.String())
+		}
+		if !static {
+			continue
+		}
+		// The file system is not touched at all anymore.
+		if err := os.RemoveAll(ts.root); err != nil {
+			t.Fatal(err)
+		}
+		w = httptest.NewRecorder()
+		if err := ts.Render(w, 200, testPage{}); err != nil || w.Body.String() != expect {
+			t.Fatal(err, w.Body.String())
+		}
+	}
+}
+
+func TestConditionalGET(t *testing.T) {
+	ts, _ := testTemplates(t, "page {{.X}}")
+	w := httptest.NewRecorder()
+	if err := ts.Render(w, 200, testPage{1}); err != nil {
+		t.Fatal(err)
+	}
+	tag := w.Header().Get("ETag")
+	if tag == "" || w.Body.String() != "page 1" {
+		t.Fatal(w.Header(), w.Body.String())
+	}
+	for _, c := range []struct {
+		method string
+		match  string
+		page   int
+		status int // Passed to `Render`.
+		code   int // Actually sent.
+	}{
+		{"GET", tag, 1, 200, 304},
+		{"GET", `"abc", ` + tag, 1, 200, 304},
+		{"GET", "W/" + tag, 1, 200, 304},
+		{"GET", "*", 1, 200, 304},
+		{"GET", `"abc"`, 1, 200, 200},
+		{"GET", tag, 2, 200, 200},
+		{"POST", tag, 1, 200, 200},
+		// Errors are always sent in full.
+		{"GET", tag, 1, 404, 404},
+	} {
+		r := httptest.NewRequest(c.method, "/", nil)
+		r.Header.Set("If-None-Match", c.match)
+		w := httptest.NewRecorder()
+		if err := ts.Render(ConditionalGET(w, r), c.status, testPage{c.page}); err != nil {
+			t.Fatal(err)
+		}
+		body := fmt.Sprintf("page %d", c.page)
+		if c.code == 304 {
+			body = ""
+		}
+		if w.Code != c.code || w.Body.String() != body {
+			t.Fatalf("%s %s: %d %q", c.method, c.match, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestErrorText(t *testing.T) {
+	RegisterErrorText(404, "Nope.", "Nothing to see.")
+	RegisterErrorText(418, "", "Coffee?")
+	defer delete(errorTexts, 404)
+	defer delete(errorTexts, 418)
+	for _, c := range []struct {
+		page    ErrorTemplate
+		message string
+		comment string
+	}{
+		{ErrorTemplate{404, ""}, "Nope.", "Nothing to see."},
+		// A message passed to `RenderError` still wins.
+		{ErrorTemplate{404, "No such user."}, "No such user.", "Nothing to see."},
+		{ErrorTemplate{418, ""}, "I'm a little teapot.", "Coffee?"},
+		{ErrorTemplate{403, ""}, "FOREBODEN.", "you're just a dirty hacker, aren't you?"},
+	} {
+		if message, comment := c.page.DisplayMessage(), c.page.DisplayComment(); message != c.message || comment != c.comment {
+			t.Fatal(c.page, message, comment)
+		}
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	ts, _ := testTemplates(t, "page")
+	w := httptest.NewRecorder()
+	if err := ts.Render(w, 200, testPage{}); err != nil {
+		t.Fatal(err)
+	}
+	if w.Header().Get("Content-Type") != "text/html; charset=utf-8" || w.Header().Get("X-Frame-Options") != "" {
+		t.Fatal(w.Header())
+	}
+	ts.Headers = SecurityHeaders
+	for _, render := range []func(http.ResponseWriter, int, viewmodel) error{ts.Render, ts.RenderStream} {
+		w = httptest.NewRecorder()
+		if err := render(w, 200, testPage{}); err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range SecurityHeaders {
+			if w.Header().Get(k) != v {
+				t.Fatal(w.Header())
+			}
+		}
+		if w.Header().Get("Content-Type") != "text/html; charset=utf-8" {
+			t.Fatal(w.Header())
+		}
+	}
+}
+
+type testFormats struct {
+	D time.Duration
+	N int64
+	B float64
+	T time.Time
+}
+
+func (testFormats) TemplateFile() string { return "test.html" }
+
+func TestTemplateFuncs(t *testing.T) {
+	ts, _ := testTemplates(t, "{{duration .D}}|{{humanBytes .N}}|{{bitrate .B}}|{{relTime .T}}")
+	for _, c := range []struct {
+		vm     testFormats
+		at     time.Duration // `T`, relative to when the template is rendered.
+		expect string
+	}{
+		{testFormats{2*time.Hour + 14*time.Minute + 5*time.Second, 3 << 30, 1.5e6, time.Time{}}, -3*time.Minute - time.Second,
+			"2h 14m|3.00 GiB|1.5 Mbps|3 minutes ago"},
+		{testFormats{65 * time.Second, 10, 500, time.Time{}}, time.Hour + time.Minute,
+			"1m 5s|10 bytes|500 bps|in 1 hour"},
+		{testFormats{12*time.Second + time.Millisecond, 0, 2500, time.Time{}}, 0,
+			"12s|0 bytes|2.5 Kbps|just now"},
+	} {
+		c.vm.T = time.Now().Add(c.at)
+		w := httptest.NewRecorder()
+		if err := ts.Render(w, 200, c.vm); err != nil {
+			t.Fatal(err)
+		}
+		if w.Body.String() != c.expect {
+			t.Fatal(w.Body.String())
+		}
+	}
+}
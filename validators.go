@@ -1,6 +1,7 @@
 package main
 
 import (
+	"net/url"
 	"strings"
 	"unicode"
 )
@@ -17,6 +18,30 @@ func ValidateUsername(name string) error {
 	return nil
 }
 
+// Categories are free-form, but short. An empty one means the stream has none.
+func ValidateCategory(category string) error {
+	if len(category) > 64 {
+		return ErrInvalidCategory
+	}
+	for _, c := range category {
+		if !unicode.IsGraphic(c) {
+			return ErrInvalidCategory
+		}
+	}
+	return nil
+}
+
+func ValidateAvatarURL(link string) error {
+	if link == "" {
+		return nil
+	}
+	u, err := url.Parse(link)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || len(link) > 256 {
+		return ErrInvalidURL
+	}
+	return nil
+}
+
 func ValidateEmail(email string) error {
 	if !strings.ContainsRune(email, '@') || len(email) < 3 || len(email) > 255 {
 		return ErrInvalidEmail
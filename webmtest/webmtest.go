@@ -0,0 +1,186 @@
+// Package webmtest builds WebM fragments for feeding to `Broadcast.Write` in tests,
+// so that they can say "a keyframe of track 1 at 40ms" instead of spelling out bytes.
+//
+// Everything returns a byte slice, and fragments are simply concatenated:
+//
+//	stream := webmtest.Cat(
+//	    webmtest.Header(),
+//	    webmtest.Segment(),
+//	    webmtest.Info(1000000),
+//	    webmtest.Tracks(webmtest.Video(1, "V_VP8", 640, 480), webmtest.Audio(2, "A_OPUS")),
+//	    webmtest.Cluster(0),
+//	    webmtest.SimpleBlock(1, 0, true, []byte{...}),
+//	)
+//
+// Segments and clusters have indeterminate length, like in a live stream, so there's
+// no need to know their contents in advance. Nothing here checks that the result
+// makes sense; that's the point, as malformed input has to be tested too.
+package webmtest
+
+const (
+	TagEBML            = 0x1A45DFA3
+	TagEBMLVersion     = 0x4286
+	TagEBMLReadVersion = 0x42F7
+	TagDocType         = 0x4282
+	TagSegment         = 0x18538067
+	TagInfo            = 0x1549A966
+	TagTimecodeScale   = 0x2AD7B1
+	TagTracks          = 0x1654AE6B
+	TagTrackEntry      = 0xAE
+	TagTrackNumber     = 0xD7
+	TagTrackType       = 0x83
+	TagCodecID         = 0x86
+	TagDefaultDuration = 0x23E383
+	TagVideo           = 0xE0
+	TagPixelWidth      = 0xB0
+	TagPixelHeight     = 0xBA
+	TagAudio           = 0xE1
+	TagCluster         = 0x1F43B675
+	TagTimecode        = 0xE7
+	TagSimpleBlock     = 0xA3
+	TagBlockGroup      = 0xA0
+	TagBlock           = 0xA1
+	TagReferenceBlock  = 0xFB
+)
+
+// Values of `TrackType`.
+const (
+	TypeVideo = 1
+	TypeAudio = 2
+)
+
+// A tag with the given contents. The ID is written as is (so it must include
+// the length marker bits, like all of the constants above), and the length uses
+// the shortest encoding that fits.
+func Tag(id uint32, contents ...[]byte) []byte {
+	body := Cat(contents...)
+	return append(append(encodeID(id), encodeLength(uint64(len(body)))...), body...)
+}
+
+// A tag with indeterminate length, i.e. only its header. The contents follow,
+// and it ends at the next tag of the same or a higher level.
+func Open(id uint32) []byte {
+	return append(encodeID(id), 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF)
+}
+
+// An unsigned integer tag, e.g. `Uint(TagTrackNumber, 1)`.
+func Uint(id uint32, x uint64) []byte {
+	n := 1
+	for x>>(8*uint(n)) != 0 && n < 8 {
+		n++
+	}
+	buf := make([]byte, n)
+	for i := n - 1; i >= 0; i-- {
+		buf[i], x = byte(x), x>>8
+	}
+	return Tag(id, buf)
+}
+
+// A string tag, e.g. `String(TagCodecID, "V_VP9")`.
+func String(id uint32, s string) []byte {
+	return Tag(id, []byte(s))
+}
+
+// All of the arguments, one after another.
+func Cat(parts ...[]byte) []byte {
+	var r []byte
+	for _, p := range parts {
+		r = append(r, p...)
+	}
+	return r
+}
+
+// The EBML header of a WebM file.
+func Header() []byte {
+	return Tag(TagEBML, Uint(TagEBMLVersion, 1), Uint(TagEBMLReadVersion, 1), String(TagDocType, "webm"))
+}
+
+// The start of a segment. `Info` and `Tracks` go next, then clusters.
+func Segment() []byte {
+	return Open(TagSegment)
+}
+
+// Segment info. `scale` is in nanoseconds per unit of block timecodes; WebM uses
+// 1000000, i.e. milliseconds.
+func Info(scale uint64) []byte {
+	return Tag(TagInfo, Uint(TagTimecodeScale, scale))
+}
+
+// A `TrackEntry` for a video track. `Width` and `Height` are omitted if zero.
+func Video(number uint64, codec string, width uint64, height uint64) []byte {
+	var video []byte
+	if width != 0 {
+		video = append(video, Uint(TagPixelWidth, width)...)
+	}
+	if height != 0 {
+		video = append(video, Uint(TagPixelHeight, height)...)
+	}
+	return Tag(TagTrackEntry, Uint(TagTrackNumber, number), Uint(TagTrackType, TypeVideo),
+		String(TagCodecID, codec), Tag(TagVideo, video))
+}
+
+// A `TrackEntry` for an audio track.
+func Audio(number uint64, codec string) []byte {
+	return Tag(TagTrackEntry, Uint(TagTrackNumber, number), Uint(TagTrackType, TypeAudio),
+		String(TagCodecID, codec))
+}
+
+// The `Tracks` tag containing entries made by `Video` and `Audio` (or by hand.)
+func Tracks(entries ...[]byte) []byte {
+	return Tag(TagTracks, entries...)
+}
+
+// The start of a cluster with the given timecode, in units of `Info`'s scale.
+func Cluster(timecode uint64) []byte {
+	return append(Open(TagCluster), Uint(TagTimecode, timecode)...)
+}
+
+// A block of `track` at `timecode` relative to the cluster's, without lacing.
+func SimpleBlock(track uint64, timecode int16, keyframe bool, payload []byte) []byte {
+	flags := byte(0)
+	if keyframe {
+		flags |= 0x80
+	}
+	return Tag(TagSimpleBlock, block(track, timecode, flags), payload)
+}
+
+// Same as `SimpleBlock`, but in a `BlockGroup`, which is a keyframe unless it has
+// a `ReferenceBlock`. `reference` is the relative timecode of the frame it depends
+// on; 0 means none.
+func BlockGroup(track uint64, timecode int16, reference int16, payload []byte) []byte {
+	group := Tag(TagBlock, block(track, timecode, 0), payload)
+	if reference != 0 {
+		group = append(group, Tag(TagReferenceBlock, []byte{byte(reference >> 8), byte(reference)})...)
+	}
+	return Tag(TagBlockGroup, group)
+}
+
+// The header of a `Block` or `SimpleBlock`: track number, timecode, and flags.
+func block(track uint64, timecode int16, flags byte) []byte {
+	return append(encodeLength(track), byte(timecode>>8), byte(timecode), flags)
+}
+
+func encodeID(id uint32) []byte {
+	var r []byte
+	for shift := uint(24); shift != 0; shift -= 8 {
+		if id >= 1<<shift {
+			r = append(r, byte(id>>shift))
+		}
+	}
+	return append(r, byte(id))
+}
+
+// A variable-length integer: the number of leading zeros in the first byte, plus one,
+// is the total number of bytes. All ones is reserved, so 127 takes two bytes.
+func encodeLength(n uint64) []byte {
+	size := 1
+	for size < 8 && n >= 1<<(7*uint(size))-1 {
+		size++
+	}
+	r := make([]byte, size)
+	for i := size - 1; i >= 0; i-- {
+		r[i], n = byte(n), n>>8
+	}
+	r[0] |= 0x80 >> uint(size-1)
+	return r
+}
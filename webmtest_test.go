@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/andradeandrey/webmcast/webmtest"
+)
+
+func TestWebmtestTracks(t *testing.T) {
+	data := webmtest.Cat(
+		webmtest.Header(),
+		webmtest.Segment(),
+		webmtest.Info(1000000),
+		webmtest.Tracks(webmtest.Video(1, "V_VP9", 640, 480), webmtest.Audio(2, "A_OPUS")),
+		webmtest.Cluster(0),
+		webmtest.SimpleBlock(1, 0, true, []byte{1, 2, 3}),
+		webmtest.BlockGroup(2, 5, 0, []byte{4}),
+		webmtest.BlockGroup(1, 40, -40, []byte{5}),
+	)
+	if err := ParseStream(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	cast := newBroadcast(realClock{})
+	if _, err := cast.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	expect := []TrackInfo{
+		{Number: 1, Type: webmtest.TypeVideo, CodecID: "V_VP9", Width: 640, Height: 480},
+		{Number: 2, Type: webmtest.TypeAudio, CodecID: "A_OPUS"},
+	}
+	if !reflect.DeepEqual(cast.Tracks, expect) {
+		t.Fatalf("%+v", cast.Tracks)
+	}
+	if !cast.HasVideo || !cast.HasAudio || cast.Width != 640 || cast.Height != 480 {
+		t.Fatalf("%+v", cast.StreamTrackInfo)
+	}
+}
+
+func TestWebmtestBlocks(t *testing.T) {
+	for _, c := range []struct {
+		payload int
+		length  []byte // Of a `SimpleBlock` on track 1 with that much data.
+	}{
+		{122, []byte{0xFE}},
+		{123, []byte{0x40, 0x7F}}, // 127 = 0xFF would mean "unknown".
+		{124, []byte{0x40, 0x80}},
+	} {
+		key := webmtest.SimpleBlock(1, 0, true, make([]byte, c.payload))
+		if !bytes.HasPrefix(key, append([]byte{webmtest.TagSimpleBlock}, c.length...)) {
+			t.Fatalf("%d bytes: wrong length: %x", c.payload, key[:3])
+		}
+		delta := webmtest.SimpleBlock(2, 5, false, []byte{7})
+		data := webmtest.Cat(
+			webmtest.Header(),
+			webmtest.Segment(),
+			webmtest.Info(1000000),
+			webmtest.Tracks(webmtest.Video(1, "V_VP9", 640, 480), webmtest.Audio(2, "A_OPUS")),
+			webmtest.Cluster(0),
+			key,
+			delta,
+		)
+		if err := ParseStream(bytes.NewReader(data)); err != nil {
+			t.Fatalf("%d bytes: %v", c.payload, err)
+		}
+		cast := newBroadcast(realClock{})
+		ch := make(chan []byte, 100)
+		cast.Connect(ch, false, ^uint64(0))
+		if _, err := cast.Write(data); err != nil {
+			t.Fatalf("%d bytes: %v", c.payload, err)
+		}
+		// EBML header, segment header with `Info` and `Tracks`, the cluster with its first
+		// block, and then the other block on its own. Both blocks are at the start of
+		// the stream, so their timecodes are not changed.
+		chunks := received(ch)
+		if len(chunks) != 4 {
+			t.Fatalf("%d bytes: %d chunks", c.payload, len(chunks))
+		}
+		if cluster := chunks[2]; !bytes.HasPrefix(cluster, []byte{0x1F, 0x43, 0xB6, 0x75}) || !bytes.HasSuffix(cluster, key) {
+			t.Fatalf("%d bytes: wrong cluster: %x", c.payload, cluster)
+		}
+		if !bytes.Equal(chunks[3], delta) {
+			t.Fatalf("%d bytes: wrong block: %x", c.payload, chunks[3])
+		}
+	}
+}